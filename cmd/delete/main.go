@@ -1,24 +1,24 @@
 package main
 
 import (
-	"fmt"
+	"flag"
 
+	"github.com/matthewrankin/lenslocked/config"
 	"github.com/matthewrankin/lenslocked/models"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "docker"
-	dbname   = "lenslocked_dev"
-)
-
 func main() {
-	dbInfo := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	services, err := models.NewServices(dbInfo)
+	flags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := flags.Load()
+	if err != nil {
+		panic(err)
+	}
+	opts, err := cfg.Services()
+	if err != nil {
+		panic(err)
+	}
+	services, err := models.NewServices(cfg.Database.ConnectionInfo(), opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,96 @@
+// Command deleteuser processes account deletion requests received outside
+// the site, such as through support. Each account is deleted along with its
+// galleries, images and sessions, exactly like a user deleting their own
+// account from the account page.
+//
+// Usage:
+//
+//	deleteuser [-yes] email...
+//
+// With no arguments, email addresses are read from standard input, one per
+// line. Unless -yes is given, each deletion has to be confirmed.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matthewrankin/lenslocked/config"
+	"github.com/matthewrankin/lenslocked/models"
+)
+
+func main() {
+	yes := flag.Bool("yes", false, "delete without asking for confirmation")
+	flags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := flags.Load()
+	if err != nil {
+		fatal(err)
+	}
+	opts, err := cfg.Services()
+	if err != nil {
+		fatal(err)
+	}
+	services, err := models.NewServices(cfg.Database.ConnectionInfo(), opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer services.Close()
+
+	emails := flag.Args()
+	stdin := bufio.NewScanner(os.Stdin)
+	if len(emails) == 0 {
+		// Confirmations would have to come from the same input.
+		if !*yes {
+			fatal(fmt.Errorf("use -yes when reading emails from standard input"))
+		}
+		for stdin.Scan() {
+			if email := strings.TrimSpace(stdin.Text()); email != "" {
+				emails = append(emails, email)
+			}
+		}
+	}
+
+	failed := false
+	for _, email := range emails {
+		u, err := services.User.ByEmail(email)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", email, err)
+			failed = true
+			continue
+		}
+		if !*yes && !confirm(stdin, u) {
+			fmt.Printf("%s: skipped\n", email)
+			continue
+		}
+		if err := services.DeleteUser(u.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", email, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: deleted\n", email)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// confirm asks whether to delete the user and reports the answer.
+func confirm(in *bufio.Scanner, u *models.User) bool {
+	fmt.Printf("Delete %s <%s> (user %d) and all of their galleries? [y/N] ",
+		u.Name, u.Email, u.ID)
+	if !in.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(in.Text()))
+	return answer == "y" || answer == "yes"
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "deleteuser:", err)
+	os.Exit(1)
+}
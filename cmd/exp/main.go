@@ -1,24 +1,21 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 
+	"github.com/matthewrankin/lenslocked/config"
 	"github.com/matthewrankin/lenslocked/models"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "docker"
-	dbname   = "lenslocked_dev"
-)
-
 func main() {
-	dbInfo := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	services, err := models.NewServices(dbInfo)
+	flags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := flags.Load()
+	panicOn(err)
+	opts, err := cfg.Services()
+	panicOn(err)
+	services, err := models.NewServices(cfg.Database.ConnectionInfo(), opts...)
 	panicOn(err)
 	defer services.Close()
 	services.DestructiveReset()
@@ -32,14 +29,20 @@ func main() {
 	err = services.User.Create(&user)
 	panicOn(err)
 
-	// Verify that the user has a Remember and RememberHash.
-	fmt.Printf("%+v\n", user)
-	if user.Remember == "" {
+	// Sign the user in by creating a session, which should generate a
+	// remember token and its hash.
+	session := models.Session{UserID: user.ID}
+	err = services.Session.Create(&session)
+	panicOn(err)
+	fmt.Printf("%+v\n", session)
+	if session.Token == "" || session.TokenHash == "" {
 		panic("Invalid remember token")
 	}
 
-	// Now verify that we can lookup a user with that remember token.
-	user2, err := services.User.ByRemember(user.Remember)
+	// Now verify that we can lookup the session with that remember token.
+	session2, err := services.Session.ByToken(session.Token)
+	panicOn(err)
+	user2, err := services.User.ByID(session2.UserID)
 	panicOn(err)
 	fmt.Printf("%+v\n", *user2)
 }
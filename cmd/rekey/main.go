@@ -0,0 +1,130 @@
+// Command rekey helps rotate the HMAC key and the password pepper. It reports
+// which keys the stored hashes were made with, and signs out the sessions
+// still using an HMAC key that is being retired.
+//
+// Rotating a key means putting a new key first in the hmac_keys or peppers
+// secrets (see package config) and keeping the old one after it. A remember
+// token hash cannot be recomputed without the token, which only the signed
+// in browser has, so sessions move to the new key as they are used.
+// Passwords move to the new pepper as users sign in. Once few hashes are
+// left on the old key, retire it and remove it from the configuration.
+//
+// Usage:
+//
+//	rekey                                  report key usage
+//	rekey [-batch n] [-pause d] retire id  sign out sessions using key id
+//
+// Sessions are deleted n at a time, pausing d between batches. The key with
+// the empty ID, which hashes made before keys had IDs use, is retired with
+// an empty argument: rekey retire "".
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/matthewrankin/lenslocked/config"
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/models"
+)
+
+func main() {
+	batch := flag.Int("batch", 1000, "sessions to sign out at a time")
+	pause := flag.Duration("pause", time.Second, "pause between batches")
+	flags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := flags.Load()
+	if err != nil {
+		fatal(err)
+	}
+	opts, err := cfg.Services()
+	if err != nil {
+		fatal(err)
+	}
+	services, err := models.NewServices(cfg.Database.ConnectionInfo(), opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer services.Close()
+	hmacKeys, peppers := cfg.Secrets.HMACKeys, cfg.Secrets.Peppers
+
+	switch args := flag.Args(); {
+	case len(args) == 0:
+		err = report(services, hmacKeys, peppers)
+	case len(args) == 2 && args[0] == "retire":
+		err = retire(services, hmacKeys, args[1], *batch, *pause)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// report prints how many hashes use each key.
+func report(services *models.Services, hmacKeys, peppers []hash.Key) error {
+	usage, err := services.KeyUsage()
+	if err != nil {
+		return err
+	}
+	for _, use := range usage {
+		keys := hmacKeys
+		if use.Pepper {
+			keys = peppers
+		}
+		fmt.Printf("%s.%s\tkey %q\t%d\t%s\n", use.Table, use.Column,
+			use.KeyID, use.Count, keyStatus(keys, use.KeyID))
+	}
+	return nil
+}
+
+// keyStatus describes the key with the given ID. No keys means the
+// development default, which has an empty ID, is in use.
+func keyStatus(keys []hash.Key, id string) string {
+	if len(keys) == 0 {
+		keys = []hash.Key{{}}
+	}
+	for i, key := range keys {
+		if key.ID == id {
+			if i == 0 {
+				return "current"
+			}
+			return "old"
+		}
+	}
+	return "not configured"
+}
+
+// retire signs out every session using the HMAC key with the given ID.
+func retire(services *models.Services, hmacKeys []hash.Key, id string,
+	batch int, pause time.Duration) error {
+	if keyStatus(hmacKeys, id) == "current" {
+		return fmt.Errorf("key %q is the current HMAC key", id)
+	}
+	var total int64
+	for {
+		n, err := services.RevokeSessionsByKey(id, batch)
+		if err != nil {
+			return err
+		}
+		total += n
+		if n < int64(batch) {
+			break
+		}
+		fmt.Printf("signed out %d sessions so far\n", total)
+		time.Sleep(pause)
+	}
+	fmt.Printf("signed out %d sessions using key %q\n", total, id)
+	fmt.Println("recovery codes made with the key stop working once it is " +
+		"removed; run rekey to see if any are left")
+	return nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rekey:", err)
+	os.Exit(1)
+}
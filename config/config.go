@@ -0,0 +1,430 @@
+// Package config holds the configuration shared by the server and the
+// commands in cmd: how to reach the database, how the server runs, and the
+// secrets it uses.
+//
+// The configuration starts from the development defaults, and is then read
+// from a JSON, YAML or TOML file, LENSLOCKED_* environment variables and
+// command line flags, each overriding the one before; see Flags.Load.
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/cookie"
+	"github.com/matthewrankin/lenslocked/internal/pkg/email"
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/password"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+	"github.com/matthewrankin/lenslocked/internal/pkg/storage"
+	"github.com/matthewrankin/lenslocked/middleware"
+	"github.com/matthewrankin/lenslocked/models"
+)
+
+// Modes the app can run in.
+const (
+	// Dev is for running on a developer's machine. Secrets that are not
+	// configured fall back to insecure defaults.
+	Dev = "dev"
+	// Prod requires real secrets, and defaults to secure cookies and
+	// encrypted database connections.
+	Prod = "prod"
+)
+
+// Config is the complete configuration.
+type Config struct {
+	// Env is the mode to run in, Dev or Prod.
+	Env string `json:"env" yaml:"env" toml:"env"`
+	// Port is the port the server listens on.
+	Port int `json:"port" yaml:"port" toml:"port"`
+	// BaseURL is where users reach the site. It is used to build the links
+	// in emails.
+	BaseURL string `json:"base_url" yaml:"base_url" toml:"base_url"`
+	// RequireVerified lists the actions that need a verified email address,
+	// such as "public_galleries". Nil keeps the default list.
+	RequireVerified []string `json:"require_verified" yaml:"require_verified" toml:"require_verified"`
+
+	Database Database `json:"database" yaml:"database" toml:"database"`
+	Session  Session  `json:"session" yaml:"session" toml:"session"`
+	Cookie   Cookie   `json:"cookie" yaml:"cookie" toml:"cookie"`
+	Uploads  Uploads  `json:"uploads" yaml:"uploads" toml:"uploads"`
+	Storage  Storage  `json:"storage" yaml:"storage" toml:"storage"`
+	Email    Email    `json:"email" yaml:"email" toml:"email"`
+	Password Password `json:"password" yaml:"password" toml:"password"`
+	Secrets  Secrets  `json:"secrets" yaml:"secrets" toml:"secrets"`
+}
+
+// Database is how to connect to PostgreSQL.
+type Database struct {
+	Host     string `json:"host" yaml:"host" toml:"host"`
+	Port     int    `json:"port" yaml:"port" toml:"port"`
+	User     string `json:"user" yaml:"user" toml:"user"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	Name     string `json:"name" yaml:"name" toml:"name"`
+	// SSLMode is passed on to the driver. It defaults to "require" in
+	// production and "disable" otherwise.
+	SSLMode string `json:"sslmode" yaml:"sslmode" toml:"sslmode"`
+}
+
+// Session holds the session timeouts; see models.SessionConfig.
+type Session struct {
+	Lifetime    Duration `json:"lifetime" yaml:"lifetime" toml:"lifetime"`
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+// Cookie sets the attributes of the cookies we set; see cookie.Policy.
+type Cookie struct {
+	// Secure defaults to true in production and false otherwise.
+	Secure *bool `json:"secure" yaml:"secure" toml:"secure"`
+	// SameSite is "lax", "strict" or "none".
+	SameSite string `json:"samesite" yaml:"samesite" toml:"samesite"`
+	Domain   string `json:"domain" yaml:"domain" toml:"domain"`
+}
+
+// Uploads limits the size of uploaded images.
+type Uploads struct {
+	// MaxImageBytes limits each image.
+	MaxImageBytes int64 `json:"max_image_bytes" yaml:"max_image_bytes" toml:"max_image_bytes"`
+	// MaxImagePixels limits the width times the height of each image.
+	MaxImagePixels int64 `json:"max_image_pixels" yaml:"max_image_pixels" toml:"max_image_pixels"`
+	// MaxRequestBytes limits the whole request, which may carry several
+	// images.
+	MaxRequestBytes int64 `json:"max_request_bytes" yaml:"max_request_bytes" toml:"max_request_bytes"`
+}
+
+// Storage selects where images are stored.
+type Storage struct {
+	// Backend is "local" for the ./images directory or "s3".
+	Backend string `json:"backend" yaml:"backend" toml:"backend"`
+	S3      S3     `json:"s3" yaml:"s3" toml:"s3"`
+}
+
+// S3 configures an S3 compatible storage service; see storage.S3Config.
+type S3 struct {
+	Endpoint  string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	Region    string `json:"region" yaml:"region" toml:"region"`
+	Bucket    string `json:"bucket" yaml:"bucket" toml:"bucket"`
+	AccessKey string `json:"access_key" yaml:"access_key" toml:"access_key"`
+	SecretKey string `json:"secret_key" yaml:"secret_key" toml:"secret_key"`
+	BaseURL   string `json:"base_url" yaml:"base_url" toml:"base_url"`
+}
+
+// Email configures how emails are sent. They go through SMTP if a host is
+// set, and are otherwise written to Dir, or to the log if that is empty.
+type Email struct {
+	From string `json:"from" yaml:"from" toml:"from"`
+	Dir  string `json:"dir" yaml:"dir" toml:"dir"`
+	SMTP SMTP   `json:"smtp" yaml:"smtp" toml:"smtp"`
+}
+
+// SMTP is the mail server to send emails through.
+type SMTP struct {
+	Host     string `json:"host" yaml:"host" toml:"host"`
+	Port     int    `json:"port" yaml:"port" toml:"port"`
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+}
+
+// Password is the password hashing policy; see password.Policy.
+type Password struct {
+	// Algorithm is "bcrypt" or "argon2id".
+	Algorithm  string `json:"algorithm" yaml:"algorithm" toml:"algorithm"`
+	BcryptCost int    `json:"bcrypt_cost" yaml:"bcrypt_cost" toml:"bcrypt_cost"`
+	Argon2Time uint32 `json:"argon2_time" yaml:"argon2_time" toml:"argon2_time"`
+	// Argon2Memory is in KiB.
+	Argon2Memory uint32 `json:"argon2_memory" yaml:"argon2_memory" toml:"argon2_memory"`
+}
+
+// Secrets are the keys the app signs and hashes with. They are required in
+// production.
+type Secrets struct {
+	// CSRFKey is 32 bytes, base64 encoded, that sign the CSRF cookie. In
+	// development a random key is used if it is unset.
+	CSRFKey string `json:"csrf_key" yaml:"csrf_key" toml:"csrf_key"`
+	// HMACKeys hash remember tokens and sign links, current key first.
+	HMACKeys []hash.Key `json:"hmac_keys" yaml:"hmac_keys" toml:"hmac_keys"`
+	// Peppers are added to passwords before hashing, current pepper first.
+	Peppers []hash.Key `json:"peppers" yaml:"peppers" toml:"peppers"`
+}
+
+// Duration is a time.Duration written like "720h" in configuration files
+// and environment variables.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses the duration with time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalText formats the duration like time.Duration.String.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns the development configuration.
+func Default() Config {
+	return Config{
+		Env:     Dev,
+		Port:    3000,
+		BaseURL: "http://localhost:3000",
+		Database: Database{
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "docker",
+			Name:     "lenslocked_dev",
+		},
+		Session: Session{
+			Lifetime:    Duration{models.DefaultSessionLifetime},
+			IdleTimeout: Duration{models.DefaultSessionIdleTimeout},
+		},
+		Cookie: Cookie{SameSite: "lax"},
+		Uploads: Uploads{
+			MaxImageBytes:   models.DefaultMaxImageBytes,
+			MaxImagePixels:  models.DefaultMaxImagePixels,
+			MaxRequestBytes: middleware.DefaultMaxBytes,
+		},
+		Storage: Storage{Backend: "local"},
+		Email: Email{
+			From: "LensLocked <support@lenslocked.com>",
+			SMTP: SMTP{Port: 587},
+		},
+		Password: Password{
+			Algorithm:    string(password.Bcrypt),
+			BcryptCost:   password.DefaultPolicy().BcryptCost,
+			Argon2Time:   password.DefaultArgon2Params.Time,
+			Argon2Memory: password.DefaultArgon2Params.Memory,
+		},
+	}
+}
+
+// IsProd reports whether the app runs in production mode.
+func (c Config) IsProd() bool {
+	return c.Env == Prod
+}
+
+// Addr is the address the server listens on.
+func (c Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// applyModeDefaults fills in the settings whose default depends on the mode.
+func (c *Config) applyModeDefaults() {
+	if c.Cookie.Secure == nil {
+		secure := c.IsProd()
+		c.Cookie.Secure = &secure
+	}
+	if c.Database.SSLMode == "" {
+		c.Database.SSLMode = "disable"
+		if c.IsProd() {
+			c.Database.SSLMode = "require"
+		}
+	}
+}
+
+// Validate returns an error describing the first problem found with the
+// configuration.
+func (c Config) Validate() error {
+	if c.Env != Dev && c.Env != Prod {
+		return fmt.Errorf("config: env must be %q or %q", Dev, Prod)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return errors.New("config: port must be between 1 and 65535")
+	}
+	u, err := url.Parse(c.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return errors.New("config: base_url must be an http or https URL")
+	}
+	if c.Database.Host == "" || c.Database.Name == "" ||
+		c.Database.Port <= 0 {
+		return errors.New("config: database host, port and name are required")
+	}
+	if c.Session.Lifetime.Duration <= 0 || c.Session.IdleTimeout.Duration < 0 {
+		return errors.New("config: session lifetime must be positive " +
+			"and the idle timeout must not be negative")
+	}
+	if c.Uploads.MaxImageBytes <= 0 || c.Uploads.MaxImagePixels <= 0 ||
+		c.Uploads.MaxRequestBytes <= 0 {
+		return errors.New("config: upload limits must be positive")
+	}
+	if _, err := c.sameSite(); err != nil {
+		return err
+	}
+	switch c.Storage.Backend {
+	case "local", "s3":
+	default:
+		return fmt.Errorf("config: unknown storage backend %q",
+			c.Storage.Backend)
+	}
+	if _, err := mail.ParseAddress(c.Email.From); err != nil {
+		return fmt.Errorf("config: invalid email from address %q: %v",
+			c.Email.From, err)
+	}
+	if c.Email.SMTP.Host != "" && c.Email.SMTP.Port <= 0 {
+		return errors.New("config: smtp port must be positive")
+	}
+	if err := c.PasswordPolicy().Validate(); err != nil {
+		return err
+	}
+	return c.validateSecrets()
+}
+
+func (c Config) validateSecrets() error {
+	s := c.Secrets
+	if c.IsProd() &&
+		(s.CSRFKey == "" || len(s.HMACKeys) == 0 || len(s.Peppers) == 0) {
+		return errors.New("config: the csrf_key, hmac_keys and peppers " +
+			"secrets are required in production")
+	}
+	if s.CSRFKey != "" {
+		if _, err := c.CSRFKey(); err != nil {
+			return err
+		}
+	}
+	if len(s.HMACKeys) > 0 {
+		if err := hash.ValidateKeys(s.HMACKeys); err != nil {
+			return fmt.Errorf("config: hmac_keys: %v", err)
+		}
+	}
+	if len(s.Peppers) > 0 {
+		if err := hash.ValidateKeys(s.Peppers); err != nil {
+			return fmt.Errorf("config: peppers: %v", err)
+		}
+	}
+	return nil
+}
+
+// ConnectionInfo returns the connection string for models.NewServices.
+func (d Database) ConnectionInfo() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quote(d.Host), d.Port, quote(d.User), quote(d.Password),
+		quote(d.Name), quote(d.SSLMode))
+}
+
+// quote quotes a connection string value if it is empty or contains
+// characters that would otherwise end it.
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, ` '\`) {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	return "'" + s + "'"
+}
+
+// Services returns the options for models.NewServices.
+func (c Config) Services() ([]models.ServicesConfig, error) {
+	store, err := c.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	return []models.ServicesConfig{
+		models.WithLogMode(!c.IsProd()),
+		models.WithMaxImageSize(c.Uploads.MaxImageBytes),
+		models.WithMaxImagePixels(c.Uploads.MaxImagePixels),
+		models.WithImageStore(store),
+		models.WithSessionTimeouts(c.Session.Lifetime.Duration,
+			c.Session.IdleTimeout.Duration),
+		models.WithPasswordPolicy(c.PasswordPolicy()),
+		models.WithKeys(c.Secrets.HMACKeys, c.Secrets.Peppers),
+	}, nil
+}
+
+// ImageStore returns the storage backend for images.
+func (c Config) ImageStore() (storage.Store, error) {
+	if c.Storage.Backend == "s3" {
+		s3 := c.Storage.S3
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			Bucket:    s3.Bucket,
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+			BaseURL:   s3.BaseURL,
+		})
+	}
+	return storage.NewLocal("images", "/images"), nil
+}
+
+// PasswordPolicy returns the policy new password hashes are made with.
+func (c Config) PasswordPolicy() password.Policy {
+	policy := password.DefaultPolicy()
+	policy.Algorithm = password.Algorithm(c.Password.Algorithm)
+	policy.BcryptCost = c.Password.BcryptCost
+	policy.Argon2.Time = c.Password.Argon2Time
+	policy.Argon2.Memory = c.Password.Argon2Memory
+	return policy
+}
+
+// CookiePolicy returns the policy for the cookies we set. Cookies last as
+// long as a session.
+func (c Config) CookiePolicy() cookie.Policy {
+	policy := cookie.DefaultPolicy()
+	policy.Secure = c.Cookie.Secure != nil && *c.Cookie.Secure
+	policy.SameSite, _ = c.sameSite()
+	policy.Domain = c.Cookie.Domain
+	policy.Lifetime = c.Session.Lifetime.Duration
+	return policy
+}
+
+func (c Config) sameSite() (http.SameSite, error) {
+	switch c.Cookie.SameSite {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		// Browsers reject SameSite=None cookies that are not Secure.
+		if c.Cookie.Secure == nil || !*c.Cookie.Secure {
+			return 0, errors.New("config: cookie samesite none " +
+				"requires secure cookies")
+		}
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("config: unknown cookie samesite mode %q",
+			c.Cookie.SameSite)
+	}
+}
+
+// EmailSender returns the sender emails go out through.
+func (c Config) EmailSender() email.Sender {
+	if c.Email.SMTP.Host == "" {
+		return &email.File{Dir: c.Email.Dir, From: c.Email.From}
+	}
+	return &email.SMTP{
+		Host:     c.Email.SMTP.Host,
+		Port:     c.Email.SMTP.Port,
+		Username: c.Email.SMTP.Username,
+		Password: c.Email.SMTP.Password,
+		From:     c.Email.From,
+	}
+}
+
+// CSRFKey returns the key that signs the CSRF cookie. If none is configured
+// a random key is returned, so forms rendered before a restart have to be
+// reloaded.
+func (c Config) CSRFKey() ([]byte, error) {
+	if c.Secrets.CSRFKey == "" {
+		return rand.Bytes(32)
+	}
+	key, err := base64.StdEncoding.DecodeString(c.Secrets.CSRFKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("config: csrf_key must be 32 base64 " +
+			"encoded bytes")
+	}
+	return key, nil
+}
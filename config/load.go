@@ -0,0 +1,195 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Flags are the command line flags shared by the server and the commands.
+type Flags struct {
+	file string
+	env  string
+	port int
+}
+
+// AddFlags defines the -config, -env and -port flags on fs.
+func AddFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.file, "config", "",
+		"configuration `file` (.json, .yaml or .toml); "+
+			"defaults to $LENSLOCKED_CONFIG")
+	fs.StringVar(&f.env, "env", "", "`mode` to run in: dev or prod")
+	fs.IntVar(&f.port, "port", 0, "`port` for the server to listen on")
+	return f
+}
+
+// Load returns the configuration, once the flags have been parsed. It starts
+// from Default and applies, in order, the configuration file, the
+// LENSLOCKED_* environment variables and the flags. The result is validated.
+func (f *Flags) Load() (Config, error) {
+	cfg := Default()
+	file := f.file
+	if file == "" {
+		file = os.Getenv("LENSLOCKED_CONFIG")
+	}
+	if file != "" {
+		if err := cfg.readFile(file); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.readEnv(); err != nil {
+		return cfg, err
+	}
+	if f.env != "" {
+		cfg.Env = f.env
+	}
+	if f.port != 0 {
+		cfg.Port = f.port
+	}
+	cfg.applyModeDefaults()
+	return cfg, cfg.Validate()
+}
+
+// readFile reads the configuration file, picking the format by its
+// extension. Settings the file leaves out keep their current value, and
+// settings this package does not know are an error.
+func (c *Config) readFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	switch ext := filepath.Ext(name); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown setting %q", undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config: unknown file type %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", name, err)
+	}
+	return nil
+}
+
+// envVars maps environment variables to the settings they override.
+func (c *Config) envVars() []struct {
+	name  string
+	value interface{}
+} {
+	return []struct {
+		name  string
+		value interface{}
+	}{
+		{"LENSLOCKED_ENV", &c.Env},
+		{"LENSLOCKED_PORT", &c.Port},
+		{"LENSLOCKED_BASE_URL", &c.BaseURL},
+		{"LENSLOCKED_DB_HOST", &c.Database.Host},
+		{"LENSLOCKED_DB_PORT", &c.Database.Port},
+		{"LENSLOCKED_DB_USER", &c.Database.User},
+		{"LENSLOCKED_DB_PASSWORD", &c.Database.Password},
+		{"LENSLOCKED_DB_NAME", &c.Database.Name},
+		{"LENSLOCKED_DB_SSLMODE", &c.Database.SSLMode},
+		{"LENSLOCKED_SESSION_LIFETIME", &c.Session.Lifetime},
+		{"LENSLOCKED_SESSION_IDLE_TIMEOUT", &c.Session.IdleTimeout},
+		{"LENSLOCKED_COOKIE_SECURE", &c.Cookie.Secure},
+		{"LENSLOCKED_COOKIE_SAMESITE", &c.Cookie.SameSite},
+		{"LENSLOCKED_COOKIE_DOMAIN", &c.Cookie.Domain},
+		{"LENSLOCKED_MAX_IMAGE_BYTES", &c.Uploads.MaxImageBytes},
+		{"LENSLOCKED_MAX_IMAGE_PIXELS", &c.Uploads.MaxImagePixels},
+		{"LENSLOCKED_MAX_UPLOAD_BYTES", &c.Uploads.MaxRequestBytes},
+		{"LENSLOCKED_STORAGE", &c.Storage.Backend},
+		{"LENSLOCKED_S3_ENDPOINT", &c.Storage.S3.Endpoint},
+		{"LENSLOCKED_S3_REGION", &c.Storage.S3.Region},
+		{"LENSLOCKED_S3_BUCKET", &c.Storage.S3.Bucket},
+		{"LENSLOCKED_S3_ACCESS_KEY", &c.Storage.S3.AccessKey},
+		{"LENSLOCKED_S3_SECRET_KEY", &c.Storage.S3.SecretKey},
+		{"LENSLOCKED_S3_BASE_URL", &c.Storage.S3.BaseURL},
+		{"LENSLOCKED_EMAIL_FROM", &c.Email.From},
+		{"LENSLOCKED_EMAIL_DIR", &c.Email.Dir},
+		{"LENSLOCKED_SMTP_HOST", &c.Email.SMTP.Host},
+		{"LENSLOCKED_SMTP_PORT", &c.Email.SMTP.Port},
+		{"LENSLOCKED_SMTP_USERNAME", &c.Email.SMTP.Username},
+		{"LENSLOCKED_SMTP_PASSWORD", &c.Email.SMTP.Password},
+		{"LENSLOCKED_PASSWORD_HASH", &c.Password.Algorithm},
+		{"LENSLOCKED_BCRYPT_COST", &c.Password.BcryptCost},
+		{"LENSLOCKED_ARGON2_TIME", &c.Password.Argon2Time},
+		{"LENSLOCKED_ARGON2_MEMORY", &c.Password.Argon2Memory},
+		{"LENSLOCKED_CSRF_KEY", &c.Secrets.CSRFKey},
+		// Lists of id:secret pairs; see hash.ParseKeys.
+		{"LENSLOCKED_HMAC_KEYS", &c.Secrets.HMACKeys},
+		{"LENSLOCKED_PEPPERS", &c.Secrets.Peppers},
+	}
+}
+
+// readEnv applies the environment variables that are set and not empty.
+// LENSLOCKED_REQUIRE_VERIFIED, a comma separated list, applies even when
+// empty, to require verification for nothing.
+func (c *Config) readEnv() error {
+	for _, v := range c.envVars() {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		if err := set(v.value, s); err != nil {
+			return fmt.Errorf("config: invalid %s: %v", v.name, err)
+		}
+	}
+	if s, ok := os.LookupEnv("LENSLOCKED_REQUIRE_VERIFIED"); ok {
+		c.RequireVerified = []string{}
+		for _, action := range strings.Split(s, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				c.RequireVerified = append(c.RequireVerified, action)
+			}
+		}
+	}
+	return nil
+}
+
+// set parses s into the setting dst points to.
+func set(dst interface{}, s string) error {
+	var err error
+	switch dst := dst.(type) {
+	case *string:
+		*dst = s
+	case *int:
+		*dst, err = strconv.Atoi(s)
+	case *int64:
+		*dst, err = strconv.ParseInt(s, 10, 64)
+	case *uint32:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 32)
+		*dst = uint32(n)
+	case **bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		*dst = &b
+	case *Duration:
+		err = dst.UnmarshalText([]byte(s))
+	case *[]hash.Key:
+		*dst, err = hash.ParseKeys(s)
+	default:
+		panic(fmt.Sprintf("config: cannot set %T", dst))
+	}
+	return err
+}
@@ -9,7 +9,8 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
 )
 
 // WithUser adds the user to the context.
@@ -26,3 +27,19 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession adds the session the current request was authenticated with to
+// the context.
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session gets the current session from the given context.
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
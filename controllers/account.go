@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/models"
+	"github.com/matthewrankin/lenslocked/views"
+)
+
+// ErrCurrentPasswordIncorrect is returned when an account change that needs
+// the current password is submitted with the wrong one.
+const ErrCurrentPasswordIncorrect publicError = "Your current password is " +
+	"incorrect."
+
+// AccountDeleter permanently deletes a user and everything belonging to
+// them. It is implemented by *models.Services.
+type AccountDeleter interface {
+	DeleteUser(id uint) error
+}
+
+// AccountForm models the forms on the account settings page.
+type AccountForm struct {
+	Name            string `schema:"name"`
+	Email           string `schema:"email"`
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+	// TwoFactorEnabled is shown on the page; it is not read from forms.
+	TwoFactorEnabled bool `schema:"-"`
+}
+
+// accountForm returns the account page form filled in for the user.
+func accountForm(user *models.User) *AccountForm {
+	return &AccountForm{
+		Name:             user.Name,
+		Email:            user.Email,
+		TwoFactorEnabled: user.TOTPEnabled(),
+	}
+}
+
+// Account renders the account settings page.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.AccountView.Render(w, r, accountForm(user))
+}
+
+// UpdateAccount changes the current user's name and email address. Changing
+// the email address requires the current password, and the new address has
+// to be verified again.
+//
+// POST /account
+func (u *Users) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	user := *context.User(r.Context())
+	form.TwoFactorEnabled = user.TOTPEnabled()
+	emailChanged := normalizeEmail(form.Email) != user.Email
+	if emailChanged {
+		if err := u.checkPassword(r, &user, form.CurrentPassword); err != nil {
+			vd.SetAlert(err)
+			u.AccountView.Render(w, r, vd)
+			return
+		}
+		user.EmailVerifiedAt = nil
+	}
+	user.Name = form.Name
+	user.Email = form.Email
+	if err := u.us.Update(&user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	*context.User(r.Context()) = user
+	msg := "Your account has been updated."
+	if emailChanged {
+		// A failure to send is logged; the user can ask for another email.
+		u.sendVerification(&user)
+		msg += " We sent a verification link to " + user.Email + "."
+	}
+	vd.Alert = &views.Alert{Level: views.AlertLvlSuccess, Message: msg}
+	u.AccountView.Render(w, r, vd)
+}
+
+// ChangePassword sets a new password for the current user. Other devices are
+// signed out, and this one gets a new session.
+//
+// POST /account/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	user := *context.User(r.Context())
+	vd.Yield = accountForm(&user)
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.checkPassword(r, &user, form.CurrentPassword); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if form.NewPassword == "" {
+		vd.SetAlert(models.ErrPasswordRequired)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	user.Password = form.NewPassword
+	if err := u.us.Update(&user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.signIn(w, r, &user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "Your password has been changed and your other devices " +
+			"have been signed out.",
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// DeleteAccount permanently deletes the current user's account, galleries
+// and images once they confirm with their password, and signs them out.
+//
+// POST /account/delete
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	user := context.User(r.Context())
+	vd.Yield = accountForm(user)
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.checkPassword(r, user, form.CurrentPassword); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.Deleter.DeleteUser(user.ID); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.signOut(w, r)
+}
+
+// checkPassword returns ErrCurrentPasswordIncorrect unless password is the
+// user's current password. Attempts are throttled like logins.
+func (u *Users) checkPassword(r *http.Request, user *models.User, password string) error {
+	_, err := u.authenticate(r, user.Email, password)
+	if err == ErrInvalidCredentials {
+		return ErrCurrentPasswordIncorrect
+	}
+	return err
+}
+
+// normalizeEmail normalizes an email address the same way the models package
+// does before storing it.
+func normalizeEmail(email string) string {
+	return strings.TrimSpace(strings.ToLower(email))
+}
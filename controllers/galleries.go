@@ -1,11 +1,18 @@
 package controllers
 
 import (
+	"fmt"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/internal/pkg/cookie"
+	"github.com/matthewrankin/lenslocked/middleware"
 	"github.com/matthewrankin/lenslocked/models"
 	"github.com/matthewrankin/lenslocked/views"
 )
@@ -14,32 +21,50 @@ import (
 const (
 	IndexGalleries = "index_galleries"
 	ShowGallery    = "show_gallery"
+	ShowSlug       = "show_gallery_slug"
 	EditGallery    = "edit_gallery"
 
-	maxMultipartMem = 1 << 20 // 1 megabyte
+	// galleryAccessDuration is how long a visitor stays unlocked after
+	// entering a gallery's password.
+	galleryAccessDuration = 7 * 24 * time.Hour
+
+	// maxImageLinkDays is the longest a signed image link may be valid for.
+	maxImageLinkDays = 30
 )
 
 // Galleries models the galleries.
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New          *views.View
+	ShowView     *views.View
+	EditView     *views.View
+	IndexView    *views.View
+	PasswordView *views.View
+	// Cookie is the policy gallery access cookies are set with.
+	Cookie cookie.Policy
+	// RequireVerified lists the actions limited to users with a verified
+	// email address.
+	RequireVerified VerifiedActions
+	gs              models.GalleryService
+	is              models.ImageService
+	lts             models.LoginThrottleService
+	r               *mux.Router
 }
 
 // NewGalleries creates new galleries given the GalleryService.
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService,
+	lts models.LoginThrottleService, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:             views.NewView("bootstrap", "galleries/new"),
+		ShowView:        views.NewView("bootstrap", "galleries/show"),
+		EditView:        views.NewView("bootstrap", "galleries/edit"),
+		IndexView:       views.NewView("bootstrap", "galleries/index"),
+		PasswordView:    views.NewView("bootstrap", "galleries/password"),
+		Cookie:          cookie.DefaultPolicy(),
+		RequireVerified: DefaultVerifiedActions(),
+		gs:              gs,
+		is:              is,
+		lts:             lts,
+		r:               r,
 	}
 }
 
@@ -53,9 +78,16 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
+	if form.Visibility == models.VisibilityPublic &&
+		!g.RequireVerified.Allowed(user, ActionPublicGallery) {
+		vd.SetAlert(ErrEmailUnverified)
+		g.New.Render(w, r, vd)
+		return
+	}
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:      form.Title,
+		Visibility: form.Visibility,
+		UserID:     user.ID,
 	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
@@ -89,11 +121,166 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	g.show(w, r, gallery, false)
+}
+
+// ShowBySlug handles the GET /g/:slug
+func (g *Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.show(w, r, gallery, true)
+}
+
+// show renders the gallery if the current user may view it, asking for the
+// gallery's password first when it is locked.
+func (g *Galleries) show(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, withLink bool) {
+	if !gallery.CanView(context.User(r.Context()), withLink) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
 	var vd views.Data
 	vd.Yield = gallery
+	if !unlocked(r, g.gs, gallery) {
+		g.PasswordView.Render(w, r, vd)
+		return
+	}
 	g.ShowView.Render(w, r, vd)
 }
 
+// Unlock handles the POST /galleries/:id and POST /g/:slug
+//
+// It checks the password entered for a locked gallery and, if it is correct,
+// sets a cookie granting access to the gallery and its images.
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	var gallery *models.Gallery
+	var err error
+	_, withLink := mux.Vars(r)["slug"]
+	if withLink {
+		gallery, err = g.galleryBySlug(w, r)
+	} else {
+		gallery, err = g.galleryByID(w, r)
+	}
+	if err != nil {
+		return
+	}
+	if !gallery.CanView(context.User(r.Context()), withLink) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form GalleryPasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.PasswordView.Render(w, r, vd)
+		return
+	}
+	token, err := g.unlock(r, gallery, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		g.PasswordView.Render(w, r, vd)
+		return
+	}
+	http.SetCookie(w, g.Cookie.New(galleryAccessCookie(gallery.ID), token,
+		time.Now().Add(galleryAccessDuration)))
+	http.Redirect(w, r, r.URL.Path, http.StatusFound)
+}
+
+// unlock checks the gallery password, throttling attempts per gallery and
+// per IP address in the same way as logins.
+func (g *Galleries) unlock(r *http.Request, gallery *models.Gallery, password string) (string, error) {
+	ip := remoteIP(r)
+	if err := g.lts.CheckGallery(ip, gallery.ID); err != nil {
+		return "", err
+	}
+	token, err := g.gs.Unlock(gallery, password)
+	switch err {
+	case nil:
+		if err := g.lts.SucceededGallery(gallery.ID); err != nil {
+			log.Println(err)
+		}
+		return token, nil
+	case models.ErrPasswordIncorrect:
+		if err := g.lts.FailedGallery(ip, gallery.ID); err != nil {
+			log.Println(err)
+		}
+		return "", err
+	default:
+		return "", err
+	}
+}
+
+// SetPassword handles the POST /galleries/:id/password
+func (g *Galleries) SetPassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form GalleryPasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	msg := "Gallery password successfully updated!"
+	switch {
+	case form.Remove:
+		gallery.PasswordHash = ""
+		msg = "Gallery password removed."
+	case form.Password == "":
+		vd.SetAlert(models.ErrPasswordRequired)
+		g.EditView.Render(w, r, vd)
+		return
+	default:
+		gallery.Password = form.Password
+	}
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: msg,
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// RegenerateLink handles the POST /galleries/:id/share
+//
+// It replaces the gallery's slug so any previously shared link stops working.
+func (g *Galleries) RegenerateLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	gallery.Slug = ""
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+	} else {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "New share link created. The old link no longer works.",
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
+
 // Edit handles the GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -130,7 +317,15 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	if form.Visibility == models.VisibilityPublic &&
+		gallery.Visibility != models.VisibilityPublic &&
+		!g.RequireVerified.Allowed(user, ActionPublicGallery) {
+		vd.SetAlert(ErrEmailUnverified)
+		g.EditView.Render(w, r, vd)
+		return
+	}
 	gallery.Title = form.Title
+	gallery.Visibility = form.Visibility
 	err = g.gs.Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
@@ -156,7 +351,12 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var vd views.Data
-	err = g.gs.Delete(gallery.ID)
+	// Remove the images first so a deleted gallery never leaves its photos
+	// publicly reachable under /images/.
+	err = g.is.DeleteByGalleryID(gallery.ID)
+	if err == nil {
+		err = g.gs.Delete(gallery.ID)
+	}
 	if err != nil {
 		vd.SetAlert(err)
 		vd.Yield = gallery
@@ -184,33 +384,47 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	var vd views.Data
 	vd.Yield = gallery
-	err = r.ParseMultipartForm(maxMultipartMem)
-	if err != nil {
-		vd.SetAlert(err)
+	if !g.RequireVerified.Allowed(user, ActionUploadImages) {
+		vd.SetAlert(ErrEmailUnverified)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	// The CSRF middleware has already parsed the form, within the limit set
+	// by middleware.MaxBytes.
+	if middleware.BodyTooLarge(r) {
+		vd.SetAlert(ErrUploadTooLarge)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["images"]
+	}
 
-	// Iterate over uploaded files to process them.
-	files := r.MultipartForm.File["images"]
+	// Iterate over uploaded files to process them. Files that are rejected
+	// are collected so the user can be told about all of them at once.
+	var rejected uploadError
 	for _, f := range files {
 		// Open the uploaded file
 		file, err := f.Open()
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+			rejected = append(rejected, rejectedFile{f.Filename, err})
+			continue
 		}
-		defer file.Close()
-
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		_, err = g.is.Create(gallery.ID, file, f.Filename)
+		file.Close()
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+			rejected = append(rejected, rejectedFile{f.Filename, err})
 		}
 	}
 
+	// Reload the images so the page shows everything that was accepted.
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+	if len(rejected) > 0 {
+		vd.SetAlert(rejected)
+		g.EditView.Render(w, r, vd)
+		return
+	}
 	vd.Alert = &views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: "Images successfully uploaded!",
@@ -218,6 +432,94 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	g.EditView.Render(w, r, vd)
 }
 
+// ImageDelete handles the POST /galleries/:id/images/:filename/delete
+func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+	image, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err == nil {
+		err = g.is.Delete(image)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id",
+		strconv.Itoa(int(gallery.ID)))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// ImageLink handles the POST /galleries/:id/images/:filename/link
+//
+// It creates a signed link to the image that works for a limited number of
+// days regardless of the gallery's visibility or password.
+func (g *Galleries) ImageLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	if !g.RequireVerified.Allowed(user, ActionShareLinks) {
+		vd.SetAlert(ErrEmailUnverified)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	var form ImageLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if form.Days < 1 || form.Days > maxImageLinkDays {
+		vd.AlertError(fmt.Sprintf("Links can be valid for 1 to %d days.",
+			maxImageLinkDays))
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	image, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	expires := time.Now().AddDate(0, 0, form.Days)
+	link := g.is.SignURL(image, expires)
+	if strings.HasPrefix(link, "/") {
+		// Links are meant to be pasted into emails and other sites.
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		link = scheme + "://" + r.Host + link
+	}
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlInfo,
+		Message: fmt.Sprintf("Link valid until %s: %s",
+			expires.Format("Jan 2, 2006 3:04 PM"), link),
+	}
+	g.EditView.Render(w, r, vd)
+}
+
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -242,7 +544,56 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	return gallery, nil
 }
 
+func (g *Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := g.gs.BySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.Images = images
+	return gallery, nil
+}
+
+// unlocked reports whether the current request may see the contents of the
+// gallery: it has no password, the current user owns it, or the request
+// carries a valid access cookie from Unlock.
+func unlocked(r *http.Request, gs models.GalleryService, gallery *models.Gallery) bool {
+	if !gallery.Locked(context.User(r.Context())) {
+		return true
+	}
+	cookie, err := r.Cookie(galleryAccessCookie(gallery.ID))
+	if err != nil {
+		return false
+	}
+	return gs.HasAccess(gallery, cookie.Value)
+}
+
+// galleryAccessCookie returns the name of the cookie holding the access
+// token for a password protected gallery.
+func galleryAccessCookie(galleryID uint) string {
+	return fmt.Sprintf("gallery_access_%d", galleryID)
+}
+
 // GalleryForm models the form for a gallery.
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title      string `schema:"title"`
+	Visibility string `schema:"visibility"`
+}
+
+// GalleryPasswordForm models the form used to set or enter a gallery's
+// password.
+type GalleryPasswordForm struct {
+	Password string `schema:"password"`
+	Remove   bool   `schema:"remove"`
+}
+
+// ImageLinkForm models the form used to create a signed image link.
+type ImageLinkForm struct {
+	Days int `schema:"days"`
 }
@@ -1,15 +1,71 @@
 package controllers
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/schema"
+	"github.com/matthewrankin/lenslocked/views"
 )
 
+// ErrUploadTooLarge is returned when an upload request exceeds the maximum
+// allowed request size.
+const ErrUploadTooLarge publicError = "The upload is too large. Please upload fewer or smaller images at a time."
+
+// ErrInvalidCredentials is returned when logging in with an unknown email
+// address or the wrong password. The two are not told apart.
+const ErrInvalidCredentials publicError = "Invalid email address or password."
+
+// publicError is an error whose message is safe to show to users.
+type publicError string
+
+func (e publicError) Error() string {
+	return string(e)
+}
+
+func (e publicError) Public() string {
+	return string(e)
+}
+
+// rejectedFile records an uploaded file that was not accepted and why.
+type rejectedFile struct {
+	Filename string
+	Err      error
+}
+
+// uploadError lists every file rejected during a single upload request.
+type uploadError []rejectedFile
+
+func (e uploadError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = fmt.Sprintf("%s: %v", f.Filename, f.Err)
+	}
+	return "controllers: files rejected: " + strings.Join(msgs, "; ")
+}
+
+// Public lists the rejected files along with the reason each one was
+// rejected, hiding the details of any non-public errors.
+func (e uploadError) Public() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		reason := views.AlertMsgGeneric
+		if pErr, ok := f.Err.(views.PublicError); ok {
+			reason = pErr.Public()
+		}
+		msgs[i] = fmt.Sprintf("%s (%s)", f.Filename, reason)
+	}
+	return "The following images were not uploaded: " +
+		strings.Join(msgs, "; ")
+}
+
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
 	}
 	dec := schema.NewDecoder()
+	// Forms carry fields that are not ours to decode, like the CSRF token.
+	dec.IgnoreUnknownKeys(true)
 	return dec.Decode(dst, r.PostForm)
 }
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/models"
+)
+
+// Cache lifetimes for served images. Image files never change once stored,
+// so the only reason to expire them is that a gallery's visibility may.
+const (
+	publicImageMaxAge  = 24 * time.Hour
+	privateImageMaxAge = time.Hour
+)
+
+// NewImages creates the controller that serves image files.
+func NewImages(gs models.GalleryService, is models.ImageService) *Images {
+	return &Images{
+		gs: gs,
+		is: is,
+	}
+}
+
+// Images serves the image files stored for galleries, applying the same
+// visibility and password rules as the galleries themselves.
+type Images struct {
+	gs models.GalleryService
+	is models.ImageService
+}
+
+// Show handles the GET /images/galleries/:id/:filename
+func (i *Images) Show(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := i.gs.ByID(uint(id))
+	if err != nil {
+		i.error(w, r, err)
+		return
+	}
+	image, err := i.is.ByFile(gallery.ID, vars["filename"])
+	if err != nil {
+		i.error(w, r, err)
+		return
+	}
+	signed, expires := i.signed(r, image)
+	// Image filenames are random, so knowing one is as good as knowing the
+	// gallery's unlisted link. Every failure looks the same so the response
+	// does not reveal whether the gallery or image exists. The store is only
+	// read once the request is authorized.
+	if !signed && (!gallery.CanView(context.User(r.Context()), true) ||
+		!unlocked(r, i.gs, gallery)) {
+		http.NotFound(w, r)
+		return
+	}
+	rc, err := i.is.Open(image, vars["filename"])
+	if err != nil {
+		i.error(w, r, err)
+		return
+	}
+	defer rc.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", image.ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	// Stored files are never overwritten, so the filename identifies the
+	// content.
+	h.Set("ETag", strconv.Quote(vars["filename"]))
+	switch {
+	case signed:
+		// Never let the response outlive the signature.
+		maxAge := time.Until(expires)
+		if maxAge > privateImageMaxAge {
+			maxAge = privateImageMaxAge
+		}
+		h.Set("Cache-Control", cacheControl("private", maxAge))
+	case gallery.Visibility == models.VisibilityPublic && gallery.PasswordHash == "":
+		h.Set("Cache-Control", cacheControl("public", publicImageMaxAge))
+	default:
+		h.Set("Cache-Control", cacheControl("private", privateImageMaxAge))
+	}
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		// ServeContent handles conditional and range requests for us.
+		http.ServeContent(w, r, "", image.CreatedAt, rs)
+		return
+	}
+	if r.Header.Get("If-None-Match") == h.Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Last-Modified", image.CreatedAt.UTC().Format(http.TimeFormat))
+	io.Copy(w, rc)
+}
+
+// signed reports whether the request carries a valid signature for the image
+// and, if so, when it expires.
+func (i *Images) signed(r *http.Request, image *models.Image) (bool, time.Time) {
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	if signature == "" {
+		return false, time.Time{}
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !i.is.CheckSignature(image, expires, signature) {
+		return false, time.Time{}
+	}
+	return true, time.Unix(expires, 0)
+}
+
+func (i *Images) error(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound, models.ErrImageNotFound, models.ErrFilenameInvalid:
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+}
+
+func cacheControl(scope string, maxAge time.Duration) string {
+	return scope + ", max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+}
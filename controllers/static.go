@@ -1,19 +1,46 @@
 package controllers
 
 import (
+	"net/http"
+
+	"github.com/matthewrankin/lenslocked/middleware"
 	"github.com/matthewrankin/lenslocked/views"
+
+	"github.com/gorilla/csrf"
 )
 
 // NewStatic creates the static views.
 func NewStatic() *Static {
 	return &Static{
-		Home:    views.NewView("bootstrap", "static/home"),
-		Contact: views.NewView("bootstrap", "static/contact"),
+		Home:      views.NewView("bootstrap", "static/home"),
+		Contact:   views.NewView("bootstrap", "static/contact"),
+		Forbidden: views.NewView("bootstrap", "static/forbidden"),
 	}
 }
 
 // Static models the various static views.
 type Static struct {
-	Home    *views.View
-	Contact *views.View
+	Home      *views.View
+	Contact   *views.View
+	Forbidden *views.View
+}
+
+// CSRFFailure is called by the CSRF middleware when a form is submitted
+// without a valid CSRF token. Bodies over the middleware.MaxBytes limit are
+// cut off before the token can be read, so they are explained separately.
+func (s *Static) CSRFFailure(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	switch {
+	case middleware.BodyTooLarge(r):
+		vd.SetAlert(ErrUploadTooLarge)
+	case csrf.FailureReason(r) == csrf.ErrNoToken:
+		vd.AlertError("Your session has expired or cookies are disabled. " +
+			"Please enable cookies and try again.")
+	default:
+		vd.AlertError("This form has expired or was submitted from " +
+			"another site, so we did not process it.")
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	s.Forbidden.Render(w, r, vd)
 }
@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/models"
+	"github.com/matthewrankin/lenslocked/views"
+)
+
+// loginChallengeCookie holds the token proving a user with two-factor
+// authentication entered their password, while they are asked for a code.
+const loginChallengeCookie = "login_challenge"
+
+// loginChallengeDuration is how long the login challenge cookie is kept; the
+// token in it expires after the same time.
+const loginChallengeDuration = 5 * time.Minute
+
+// TwoFactorForm models the forms used to enter a two-factor code.
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// TwoFactorSetup is the data used to render the two-factor setup page.
+type TwoFactorSetup struct {
+	Secret string
+	URI    string
+}
+
+// LoginTwoFactor checks the two-factor code, or a recovery code, of a user
+// who has entered their password, and signs them in.
+//
+// POST /login/2fa
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	challenge, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	user, err := u.tfs.ByLoginChallenge(challenge.Value)
+	if err != nil {
+		vd.AlertError("Your sign in has expired. Please log in again.")
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	ip := remoteIP(r)
+	if err := u.lts.Check(ip, user.Email); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.tfs.Verify(user, form.Code); err != nil {
+		if err == models.ErrTOTPCodeInvalid {
+			if err := u.lts.Failed(ip, user.Email); err != nil {
+				log.Println(err)
+			}
+		}
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.lts.Succeeded(user.Email); err != nil {
+		log.Println(err)
+	}
+	http.SetCookie(w, u.Cookie.Expire(loginChallengeCookie))
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// SetupTwoFactor generates a new two-factor secret for the current user and
+// shows it, so they can add it to their authenticator app.
+//
+// POST /account/2fa/setup
+func (u *Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	vd.Yield = accountForm(user)
+	if err := u.tfs.Enroll(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.TwoFactorSetupView.Render(w, r, &TwoFactorSetup{
+		Secret: user.TOTPSecret,
+		URI:    u.tfs.URI(user),
+	})
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user enters a
+// code from their app, and shows their recovery codes.
+//
+// POST /account/2fa/enable
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	vd.Yield = &TwoFactorSetup{Secret: user.TOTPSecret, URI: u.tfs.URI(user)}
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorSetupView.Render(w, r, vd)
+		return
+	}
+	codes, err := u.tfs.Enable(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorSetupView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is now enabled.",
+	}
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// DisableTwoFactor turns off two-factor authentication once the user
+// confirms with their password.
+//
+// POST /account/2fa/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	vd.Yield = accountForm(user)
+	var form AccountForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.checkPassword(r, user, form.CurrentPassword); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.tfs.Disable(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = accountForm(user)
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication has been disabled.",
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// completeLogin signs in a user who has entered their password, or, if they
+// have two-factor authentication enabled, asks them for a code first. The
+// account's failed logins are only cleared once they are fully signed in.
+func (u *Users) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if user.TOTPEnabled() {
+		token := u.tfs.LoginChallenge(user)
+		http.SetCookie(w, u.Cookie.New(loginChallengeCookie, token,
+			time.Now().Add(loginChallengeDuration)))
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
+	}
+	if err := u.lts.Succeeded(user.Email); err != nil {
+		log.Println(err)
+	}
+	if err := u.signIn(w, r, user); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+	return nil
+}
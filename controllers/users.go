@@ -1,10 +1,17 @@
 package controllers
 
 import (
-	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+	"github.com/gorilla/mux"
+	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/internal/pkg/cookie"
+	"github.com/matthewrankin/lenslocked/internal/pkg/email"
 	"github.com/matthewrankin/lenslocked/models"
 	"github.com/matthewrankin/lenslocked/views"
 )
@@ -17,19 +24,58 @@ type SignupForm struct {
 }
 
 // NewUsers handles creating a new user.
-func NewUsers(us models.UserService) *Users {
+func NewUsers(us models.UserService, ss models.SessionService,
+	lts models.LoginThrottleService, tfs models.TwoFactorService,
+	emailer email.Sender) *Users {
 	return &Users{
-		NewView:   views.NewView("bootstrap", "users/new"),
-		LoginView: views.NewView("bootstrap", "users/login"),
-		us:        us,
+		NewView:      views.NewView("bootstrap", "users/new"),
+		LoginView:    views.NewView("bootstrap", "users/login"),
+		SessionsView: views.NewView("bootstrap", "users/sessions"),
+		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
+		VerifyView:   views.NewView("bootstrap", "users/verify"),
+		AccountView:  views.NewView("bootstrap", "users/account"),
+		TwoFactorSetupView: views.NewView("bootstrap",
+			"users/two_factor_setup"),
+		TwoFactorLoginView: views.NewView("bootstrap",
+			"users/two_factor_login"),
+		RecoveryCodesView: views.NewView("bootstrap",
+			"users/recovery_codes"),
+		Cookie:  cookie.DefaultPolicy(),
+		BaseURL: "http://localhost:3000",
+		us:      us,
+		ss:      ss,
+		lts:     lts,
+		tfs:     tfs,
+		emailer: emailer,
 	}
 }
 
 // Users models a user of the web app.
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView            *views.View
+	LoginView          *views.View
+	SessionsView       *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	VerifyView         *views.View
+	AccountView        *views.View
+	TwoFactorSetupView *views.View
+	TwoFactorLoginView *views.View
+	RecoveryCodesView  *views.View
+	// Cookie is the policy the remember_token cookie is set with.
+	Cookie cookie.Policy
+	// BaseURL is where the site is served from, used to build links in
+	// emails. It must not come from the request, whose Host header is
+	// attacker controlled.
+	BaseURL string
+	// Deleter deletes accounts, with all of their data, when users ask.
+	Deleter AccountDeleter
+	us      models.UserService
+	ss      models.SessionService
+	lts     models.LoginThrottleService
+	tfs     models.TwoFactorService
+	emailer email.Sender
 }
 
 // New is used to render the form where a user can create a new user account.
@@ -61,7 +107,9 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		u.NewView.Render(w, r, vd)
 		return
 	}
-	err := u.signIn(w, &user)
+	// A failure to send is logged; the user can ask for another email.
+	u.sendVerification(&user)
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -87,59 +135,257 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		u.LoginView.Render(w, r, vd)
 		return
 	}
-	user, err := u.us.Authenticate(form.Email, form.Password)
+	user, err := u.authenticate(r, form.Email, form.Password)
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("No user exists with that email address")
-		default:
-			vd.SetAlert(err)
-		}
+		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
 	}
-	err = u.signIn(w, user)
-	if err != nil {
+	if err := u.completeLogin(w, r, user); err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
+	}
+}
+
+// Logout is used to sign the current user out. Only the session of the device
+// logging out ends; other devices stay signed in.
+//
+// POST /logout
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	session := context.Session(r.Context())
+	if err := u.ss.Delete(session.ID); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	u.signOut(w, r)
+}
+
+// LogoutAll is used to sign the current user out of every device they are
+// signed in on by deleting all of their sessions.
+//
+// POST /logout/all
+func (u *Users) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.signOut(w, r)
+}
+
+// ResetPwForm models the forms used to request and complete a password
+// reset.
+type ResetPwForm struct {
+	Email    string `schema:"email"`
+	Token    string `schema:"token"`
+	Password string `schema:"password"`
+}
+
+// InitiateReset emails a password reset link to the given address. The same
+// message is shown whether or not an account exists, or the email could be
+// sent, so the form cannot be used to find out who has signed up. Requests
+// are throttled per email and IP address.
+//
+// POST /forgot
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+	ip := remoteIP(r)
+	if err := u.lts.CheckReset(ip, form.Email); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+	if err := u.lts.ResetRequested(ip, form.Email); err != nil {
+		log.Println(err)
+	}
+	// Failures are logged rather than shown, as most can only happen for a
+	// known address.
+	user, token, err := u.us.InitiateReset(form.Email)
+	if err == nil {
+		err = u.emailer.Send(email.Message{
+			To:      user.Email,
+			Subject: "Reset your LensLocked password",
+			Body:    resetPwEmail(u.BaseURL, token),
+		})
+	}
+	if err != nil && err != models.ErrNotFound {
+		log.Println(err)
+	}
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: "If an account exists for that email address, we have " +
+			"sent it instructions for resetting the password.",
+	}
+	u.ForgotPwView.Render(w, r, vd)
+}
+
+// ResetPw renders the form for choosing a new password. The token from the
+// emailed link is carried along in the form.
+//
+// GET /reset
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+	form := ResetPwForm{Token: r.URL.Query().Get("token")}
+	u.ResetPwView.Render(w, r, &form)
+}
+
+// CompleteReset sets the user's new password. Every existing session is
+// ended, in case the reset was prompted by someone else having access, and
+// the user is signed in afresh.
+//
+// POST /reset
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	// A reset proves control of the email address but not the second
+	// factor, so users with two-factor authentication still need a code,
+	// and any lockout is only lifted once they have entered it.
+	if err := u.completeLogin(w, r, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+}
+
+// resetPwEmail returns the body of the password reset email.
+func resetPwEmail(baseURL, token string) string {
+	v := url.Values{}
+	v.Set("token", token)
+	link := strings.TrimSuffix(baseURL, "/") + "/reset?" + v.Encode()
+	return "Hi,\n\n" +
+		"Someone, hopefully you, asked to reset the password of your " +
+		"LensLocked account. Follow this link to choose a new one:\n\n" +
+		link + "\n\n" +
+		"The link can be used once and expires in 12 hours. If you did not " +
+		"ask for a reset, you can ignore this email.\n"
+}
+
+// SessionsData is the data used to render the list of active sessions.
+type SessionsData struct {
+	Sessions  []models.Session
+	CurrentID uint
 }
 
-// CookieTest is used to display cookies set on the current user.
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// Sessions lists the devices the current user is signed in on.
+//
+// GET /account/sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		vd.SetAlert(err)
+		u.SessionsView.Render(w, r, vd)
 		return
 	}
-	user, err := u.us.ByRemember(cookie.Value)
+	vd.Yield = SessionsData{
+		Sessions:  sessions,
+		CurrentID: context.Session(r.Context()).ID,
+	}
+	u.SessionsView.Render(w, r, vd)
+}
+
+// RevokeSession signs the current user out of one of their devices.
+// Revoking the current session is the same as logging out.
+//
+// POST /account/sessions/:id/delete
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	session, err := u.ss.ByID(uint(id))
+	if err != nil || session.UserID != user.ID {
+		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
-	fmt.Fprintln(w, user)
+	if err := u.ss.Delete(session.ID); err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if session.ID == context.Session(r.Context()).ID {
+		u.signOut(w, r)
+		return
+	}
+	http.Redirect(w, r, "/account/sessions", http.StatusFound)
 }
 
-// signIn is used to sign the given user in via cookies.
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
+// authenticate checks the email address and password, throttling attempts
+// per account and per IP address. Unknown email addresses and wrong
+// passwords both result in ErrInvalidCredentials, so the response does not
+// reveal who has an account. A correct password does not lift the account's
+// lockout, as the user may still need to enter a two-factor code; see
+// completeLogin.
+func (u *Users) authenticate(r *http.Request, email, password string) (*models.User, error) {
+	ip := remoteIP(r)
+	if err := u.lts.Check(ip, email); err != nil {
+		return nil, err
+	}
+	user, err := u.us.Authenticate(email, password)
+	switch err {
+	case nil:
+		return user, nil
+	case models.ErrNotFound, models.ErrPasswordIncorrect:
+		if err := u.lts.Failed(ip, email); err != nil {
+			log.Println(err)
 		}
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, err
 	}
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+}
+
+// signIn is used to sign the given user in via cookies. Every sign in starts
+// a new session, so the user stays signed in on their other devices.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        remoteIP(r),
 	}
-	http.SetCookie(w, &cookie)
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+	http.SetCookie(w, u.Cookie.New("remember_token", session.Token,
+		session.ExpiresAt))
 	return nil
 }
+
+// signOut expires the remember_token cookie and redirects home. The session
+// itself must already have been deleted.
+func (u *Users) signOut(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, u.Cookie.Expire("remember_token"))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// remoteIP returns the IP address of the client that sent the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
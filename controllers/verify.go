@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/internal/pkg/email"
+	"github.com/matthewrankin/lenslocked/models"
+	"github.com/matthewrankin/lenslocked/views"
+)
+
+// ErrEmailUnverified is returned when a user attempts an action that requires
+// a verified email address.
+const ErrEmailUnverified publicError = "Please verify your email address " +
+	"first. Follow the link in the email we sent you when you signed up, or " +
+	"ask for a new one."
+
+// Action is something a user can do that may be restricted to users with a
+// verified email address.
+type Action string
+
+// Actions that can require a verified email address.
+const (
+	// ActionPublicGallery is making a gallery public.
+	ActionPublicGallery Action = "public_galleries"
+	// ActionUploadImages is uploading images to a gallery.
+	ActionUploadImages Action = "upload_images"
+	// ActionShareLinks is creating signed links to images.
+	ActionShareLinks Action = "share_links"
+)
+
+var actions = []Action{ActionPublicGallery, ActionUploadImages, ActionShareLinks}
+
+// VerifiedActions is the set of actions requiring a verified email address.
+type VerifiedActions map[Action]bool
+
+// DefaultVerifiedActions only requires a verified address for publishing
+// galleries.
+func DefaultVerifiedActions() VerifiedActions {
+	return VerifiedActions{ActionPublicGallery: true}
+}
+
+// ParseVerifiedActions parses a comma separated list of actions, such as
+// "public_galleries,upload_images".
+func ParseVerifiedActions(s string) (VerifiedActions, error) {
+	va := VerifiedActions{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, a := range actions {
+			if Action(name) == a {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("controllers: unknown action %q", name)
+		}
+		va[Action(name)] = true
+	}
+	return va, nil
+}
+
+// Allowed reports whether the user may perform the action.
+func (va VerifiedActions) Allowed(user *models.User, a Action) bool {
+	return !va[a] || user.Verified()
+}
+
+// VerifyEmail handles the link sent to users to verify their email address.
+//
+// GET /verify
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user, err := u.us.VerifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks! " + user.Email + " is now verified.",
+	}
+	vd.Yield = user
+	u.VerifyView.Render(w, r, vd)
+}
+
+// ResendVerification emails the current user a new verification link.
+//
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	if user.Verified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	if err := u.sendVerification(user); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: "We sent a new verification link to " + user.Email + ".",
+	}
+	u.VerifyView.Render(w, r, vd)
+}
+
+// sendVerification emails the user a link to verify their email address.
+func (u *Users) sendVerification(user *models.User) error {
+	v := url.Values{}
+	v.Set("token", u.us.VerificationToken(user))
+	link := strings.TrimSuffix(u.BaseURL, "/") + "/verify?" + v.Encode()
+	err := u.emailer.Send(email.Message{
+		To:      user.Email,
+		Subject: "Verify your LensLocked email address",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Please confirm this is your email address by following this " +
+			"link:\n\n" + link + "\n\n" +
+			"The link expires in 7 days. If you did not sign up for " +
+			"LensLocked, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
@@ -3,9 +3,12 @@ module github.com/matthewrankin/lenslocked
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/gorilla/csrf v1.6.2
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/schema v1.1.0
 	github.com/jinzhu/gorm v1.9.11
 	github.com/lib/pq v1.2.0 // indirect
 	golang.org/x/crypto v0.0.0-20191202143827-86a70503ff7e
+	gopkg.in/yaml.v2 v2.4.0
 )
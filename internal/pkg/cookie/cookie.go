@@ -0,0 +1,70 @@
+package cookie
+
+import (
+	"net/http"
+	"time"
+)
+
+// Policy describes the attributes of the cookies we set. Every cookie is
+// HttpOnly and scoped to the whole site.
+type Policy struct {
+	// Secure restricts cookies to HTTPS. It should be set in production.
+	Secure bool
+	// SameSite controls whether cookies are sent on cross-site requests.
+	SameSite http.SameSite
+	// Domain, if set, shares cookies with subdomains of it.
+	Domain string
+	// Lifetime is how long the browser keeps a cookie. Zero means until the
+	// browser is closed.
+	Lifetime time.Duration
+}
+
+// DefaultPolicy is suitable for development over plain HTTP.
+func DefaultPolicy() Policy {
+	return Policy{
+		SameSite: http.SameSiteLaxMode,
+		Lifetime: 30 * 24 * time.Hour,
+	}
+}
+
+// New returns a cookie following the policy. The cookie expires after the
+// policy's lifetime, or at notAfter if that is sooner. A zero notAfter is
+// ignored.
+func (p Policy) New(name, value string, notAfter time.Time) *http.Cookie {
+	c := p.base(name, value)
+	var expires time.Time
+	if p.Lifetime > 0 {
+		expires = time.Now().Add(p.Lifetime)
+	}
+	if !notAfter.IsZero() && (expires.IsZero() || notAfter.Before(expires)) {
+		expires = notAfter
+	}
+	if !expires.IsZero() {
+		c.Expires = expires
+		c.MaxAge = int(time.Until(expires) / time.Second)
+		if c.MaxAge <= 0 {
+			c.MaxAge = -1
+		}
+	}
+	return c
+}
+
+// Expire returns a cookie that deletes the named cookie from the browser.
+func (p Policy) Expire(name string) *http.Cookie {
+	c := p.base(name, "")
+	c.Expires = time.Unix(0, 0)
+	c.MaxAge = -1
+	return c
+}
+
+func (p Policy) base(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   p.Domain,
+		Secure:   p.Secure,
+		SameSite: p.SameSite,
+		HttpOnly: true,
+	}
+}
@@ -0,0 +1,43 @@
+// Package email sends the emails lenslocked needs, such as password reset
+// links, through a pluggable Sender.
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends email messages.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// bytes renders the message in RFC 5322 format.
+func (msg Message) bytes() []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		// Strip line breaks so values cannot inject headers.
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", msg.From)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
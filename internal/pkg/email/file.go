@@ -0,0 +1,39 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is a Sender for development and tests. It writes each message to its
+// own .eml file in Dir, or to the log when Dir is empty, instead of sending
+// it. Messages without a From address are sent from From.
+type File struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message out.
+func (f *File) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = f.From
+	}
+	if f.Dir == "" {
+		log.Printf("email: to %s\n%s", msg.To, msg.bytes())
+		return nil
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	path := filepath.Join(f.Dir, name)
+	if err := ioutil.WriteFile(path, msg.bytes(), 0644); err != nil {
+		return err
+	}
+	log.Printf("email: to %s written to %s", msg.To, path)
+	return nil
+}
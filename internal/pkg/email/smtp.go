@@ -0,0 +1,45 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP sends messages through an SMTP server. Messages without a From
+// address are sent from From.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends the message. Credentials, if set, are only sent once the
+// connection has been upgraded with STARTTLS, or to localhost.
+//
+// The From address may include a display name, as in
+// "LensLocked <support@lenslocked.com>". It is kept in the header, while the
+// envelope sender is the bare address.
+func (s *SMTP) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = s.From
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("email: invalid from address %q: %v", msg.From, err)
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	err = smtp.SendMail(addr, auth, from.Address, []string{msg.To}, msg.bytes())
+	if err != nil {
+		return fmt.Errorf("email: sending to %s: %v", msg.To, err)
+	}
+	return nil
+}
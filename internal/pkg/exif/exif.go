@@ -0,0 +1,248 @@
+// Package exif reads the handful of EXIF fields we care about from jpeg and
+// png images, and strips embedded metadata from them.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoExif is returned by Decode when the image carries no EXIF data.
+var ErrNoExif = errors.New("exif: no exif data found")
+
+// Data holds the EXIF fields read from an image. Fields missing from the
+// image are left at their zero value.
+type Data struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string // e.g. "1/250"
+	FNumber      float64
+	ISO          int
+	FocalLength  float64 // in millimeters
+	TakenAt      time.Time
+	// Orientation is the EXIF orientation value (1-8); 0 when unset.
+	Orientation int
+	// HasGPS reports whether the image contains GPS location data.
+	HasGPS bool
+}
+
+// EXIF tags we read.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Decode reads the EXIF data embedded in a jpeg or png image.
+func Decode(img []byte) (*Data, error) {
+	var tiff []byte
+	switch {
+	case bytes.HasPrefix(img, []byte{0xFF, 0xD8}):
+		tiff = jpegExif(img)
+	case bytes.HasPrefix(img, pngSignature):
+		tiff = pngExif(img)
+	}
+	if tiff == nil {
+		return nil, ErrNoExif
+	}
+	return decodeTIFF(tiff)
+}
+
+// jpegExif returns the TIFF payload of the first Exif APP1 segment.
+func jpegExif(img []byte) []byte {
+	var found []byte
+	walkJPEG(img, func(marker byte, segment []byte) {
+		payload := segment[4:]
+		if found == nil && marker == 0xE1 &&
+			bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			found = payload[6:]
+		}
+	})
+	return found
+}
+
+// pngExif returns the content of the eXIf chunk.
+func pngExif(img []byte) []byte {
+	var found []byte
+	walkPNG(img, func(typ string, chunk []byte) {
+		if typ == "eXIf" && found == nil {
+			found = chunk[8 : len(chunk)-4]
+		}
+	})
+	return found
+}
+
+type reader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+func (r *reader) u16(off int) (int, bool) {
+	if off < 0 || off+2 > len(r.b) {
+		return 0, false
+	}
+	return int(r.order.Uint16(r.b[off:])), true
+}
+
+func (r *reader) u32(off int) (int, bool) {
+	if off < 0 || off+4 > len(r.b) {
+		return 0, false
+	}
+	return int(r.order.Uint32(r.b[off:])), true
+}
+
+// entry is a single IFD entry.
+type entry struct {
+	tag, typ, count int
+	// valueOff is the offset of the value, which is either inline in the
+	// entry or elsewhere in the TIFF data.
+	valueOff int
+}
+
+var typeSizes = map[int]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (r *reader) ifd(off int) map[int]entry {
+	n, ok := r.u16(off)
+	if !ok {
+		return nil
+	}
+	entries := make(map[int]entry, n)
+	for i := 0; i < n; i++ {
+		base := off + 2 + i*12
+		tag, ok1 := r.u16(base)
+		typ, ok2 := r.u16(base + 2)
+		count, ok3 := r.u32(base + 4)
+		if !ok1 || !ok2 || !ok3 {
+			break
+		}
+		e := entry{tag: tag, typ: typ, count: count, valueOff: base + 8}
+		if typeSizes[typ]*count > 4 {
+			e.valueOff, _ = r.u32(base + 8)
+		}
+		entries[tag] = e
+	}
+	return entries
+}
+
+func (r *reader) str(e entry) string {
+	if e.typ != 2 || e.valueOff+e.count > len(r.b) {
+		return ""
+	}
+	s := string(r.b[e.valueOff : e.valueOff+e.count])
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func (r *reader) int(e entry) int {
+	switch e.typ {
+	case 3:
+		v, _ := r.u16(e.valueOff)
+		return v
+	case 4, 9:
+		v, _ := r.u32(e.valueOff)
+		return v
+	}
+	return 0
+}
+
+func (r *reader) rational(e entry) (int, int) {
+	if e.typ != 5 && e.typ != 10 {
+		return 0, 0
+	}
+	num, ok1 := r.u32(e.valueOff)
+	den, ok2 := r.u32(e.valueOff + 4)
+	if !ok1 || !ok2 {
+		return 0, 0
+	}
+	return num, den
+}
+
+func (r *reader) float(e entry) float64 {
+	num, den := r.rational(e)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+func decodeTIFF(b []byte) (*Data, error) {
+	r := &reader{b: b}
+	switch {
+	case bytes.HasPrefix(b, []byte("II*\x00")):
+		r.order = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte("MM\x00*")):
+		r.order = binary.BigEndian
+	default:
+		return nil, ErrNoExif
+	}
+	off, _ := r.u32(4)
+	ifd0 := r.ifd(off)
+	if ifd0 == nil {
+		return nil, ErrNoExif
+	}
+
+	var d Data
+	d.Make = r.str(ifd0[tagMake])
+	d.Model = r.str(ifd0[tagModel])
+	if e, ok := ifd0[tagOrientation]; ok {
+		d.Orientation = r.int(e)
+	}
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		d.HasGPS = len(r.ifd(r.int(e))) > 0
+	}
+	e, ok := ifd0[tagExifIFD]
+	if !ok {
+		return &d, nil
+	}
+	sub := r.ifd(r.int(e))
+	if e, ok := sub[tagExposureTime]; ok {
+		num, den := r.rational(e)
+		d.ExposureTime = formatExposure(num, den)
+	}
+	if e, ok := sub[tagFNumber]; ok {
+		d.FNumber = r.float(e)
+	}
+	if e, ok := sub[tagISO]; ok {
+		d.ISO = r.int(e)
+	}
+	if e, ok := sub[tagFocalLength]; ok {
+		d.FocalLength = r.float(e)
+	}
+	if e, ok := sub[tagDateTimeOriginal]; ok {
+		t, err := time.Parse("2006:01:02 15:04:05", r.str(e))
+		if err == nil {
+			d.TakenAt = t
+		}
+	}
+	d.LensModel = r.str(sub[tagLensModel])
+	return &d, nil
+}
+
+// formatExposure renders an exposure time the way cameras display it, e.g.
+// "1/250" for fast shutter speeds and "2.5" for slow ones.
+func formatExposure(num, den int) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	if num >= den {
+		v := math.Round(float64(num)/float64(den)*10) / 10
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("1/%d", (den+num/2)/num)
+}
@@ -0,0 +1,93 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Strip returns a copy of a jpeg or png image with its embedded EXIF and XMP
+// metadata removed, which includes any GPS location. The image data itself is
+// left untouched. Other formats are returned unchanged.
+func Strip(img []byte) []byte {
+	switch {
+	case bytes.HasPrefix(img, []byte{0xFF, 0xD8}):
+		return stripJPEG(img)
+	case bytes.HasPrefix(img, pngSignature):
+		return stripPNG(img)
+	}
+	return img
+}
+
+func stripJPEG(img []byte) []byte {
+	out := make([]byte, 0, len(img))
+	out = append(out, 0xFF, 0xD8)
+	end := walkJPEG(img, func(marker byte, segment []byte) {
+		// APP1 holds EXIF and XMP, APP13 holds Photoshop/IPTC metadata.
+		if marker == 0xE1 || marker == 0xED {
+			return
+		}
+		out = append(out, segment...)
+	})
+	return append(out, img[end:]...)
+}
+
+func stripPNG(img []byte) []byte {
+	out := make([]byte, 0, len(img))
+	out = append(out, pngSignature...)
+	end := walkPNG(img, func(typ string, chunk []byte) {
+		if typ == "eXIf" {
+			return
+		}
+		if typ == "iTXt" &&
+			bytes.HasPrefix(chunk[8:], []byte("XML:com.adobe.xmp\x00")) {
+			return
+		}
+		out = append(out, chunk...)
+	})
+	return append(out, img[end:]...)
+}
+
+// walkJPEG calls fn with every marker segment, including its marker and
+// length bytes, up to the start of the compressed image data. It returns the
+// offset at which walking stopped; everything from there on is image data
+// that must be copied as is.
+func walkJPEG(img []byte, fn func(marker byte, segment []byte)) int {
+	i := 2
+	for i+4 <= len(img) {
+		if img[i] != 0xFF {
+			return i
+		}
+		marker := img[i+1]
+		if marker == 0xFF {
+			// Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image.
+			return i
+		}
+		n := int(binary.BigEndian.Uint16(img[i+2:]))
+		if n < 2 || i+2+n > len(img) {
+			return i
+		}
+		fn(marker, img[i:i+2+n])
+		i += 2 + n
+	}
+	return i
+}
+
+// walkPNG calls fn with every chunk, including its length, type and CRC. It
+// returns the offset at which walking stopped.
+func walkPNG(img []byte, fn func(typ string, chunk []byte)) int {
+	i := len(pngSignature)
+	for i+12 <= len(img) {
+		n := int(binary.BigEndian.Uint32(img[i:]))
+		if n < 0 || i+12+n > len(img) {
+			return i
+		}
+		fn(string(img[i+4:i+8]), img[i:i+12+n])
+		i += 12 + n
+	}
+	return i
+}
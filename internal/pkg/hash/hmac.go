@@ -4,28 +4,87 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
+	"strings"
 )
 
-// NewHMAC creates and returns a new HMAC object.
-func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+// NewHMAC creates and returns a new HMAC object. The first key is used to
+// make new hashes; the others are only used to check existing ones, so that
+// keys can be rotated without invalidating everything hashed with the old
+// key. At least one key must be given; see ValidateKeys.
+func NewHMAC(keys ...Key) HMAC {
+	if len(keys) == 0 {
+		panic("hash: NewHMAC needs at least one key")
+	}
 	return HMAC{
-		hmac: h,
+		keys: keys,
 	}
 }
 
 // HMAC is a wrapper around the crypto/hmac package making it a little easier
-// to use in our code.
+// to use in our code. It is safe for concurrent use.
+//
+// Hashes are prefixed with the ID of the key they were made with, as in
+// "2019-12:hash". Hashes made with a key that has an empty ID have no
+// prefix, which is how hashes were made before keys had IDs.
 type HMAC struct {
-	hmac hash.Hash
+	keys []Key
 }
 
-// Hash will hash the provided input string using HMAC with the secret key
-// provided when the HMAC object was created.
+// Hash will hash the provided input string using HMAC with the current
+// secret key.
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
-	return base64.URLEncoding.EncodeToString(b)
+	return hashWith(h.keys[0], input)
+}
+
+// Hashes returns the hash of input under every key, current key first. It is
+// used to look up stored hashes that may have been made with an older key.
+func (h HMAC) Hashes(input string) []string {
+	hashes := make([]string, len(h.keys))
+	for i, key := range h.keys {
+		hashes[i] = hashWith(key, input)
+	}
+	return hashes
+}
+
+// Equal reports whether hash is the HMAC of input under any of the keys. The
+// comparison is done in constant time so it can be used to check signatures.
+func (h HMAC) Equal(input, hash string) bool {
+	id, _ := SplitKeyID(hash)
+	for _, key := range h.keys {
+		if key.ID == id {
+			return hmac.Equal([]byte(hashWith(key, input)), []byte(hash))
+		}
+	}
+	return false
+}
+
+// Current reports whether hash was made with the current key.
+func (h HMAC) Current(hash string) bool {
+	id, _ := SplitKeyID(hash)
+	return id == h.keys[0].ID
+}
+
+func hashWith(key Key, input string) string {
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
+	return JoinKeyID(key.ID, base64.URLEncoding.EncodeToString(b))
+}
+
+// JoinKeyID prefixes s with the key ID, unless the ID is empty.
+func JoinKeyID(id, s string) string {
+	if id == "" {
+		return s
+	}
+	return id + ":" + s
+}
+
+// SplitKeyID splits a string made by JoinKeyID into the key ID and the rest.
+// The rest must not contain a colon.
+func SplitKeyID(s string) (id, rest string) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", s
+	}
+	return s[:i], s[i+1:]
 }
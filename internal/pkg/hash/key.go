@@ -0,0 +1,59 @@
+package hash
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Key is a secret along with an ID that is recorded in everything made with
+// it, so that the right key can be found again once there are several.
+type Key struct {
+	ID     string
+	Secret string
+}
+
+var keyIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// ValidateKeys returns an error unless there is at least one key, every key
+// has a secret, and the IDs are unique and only use letters, digits, '-'
+// and '_'. One key may have an empty ID.
+func ValidateKeys(keys []Key) error {
+	if len(keys) == 0 {
+		return errors.New("hash: at least one key is required")
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !keyIDRegex.MatchString(key.ID) {
+			return fmt.Errorf("hash: invalid key ID %q", key.ID)
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("hash: duplicate key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+		if key.Secret == "" {
+			return fmt.Errorf("hash: key %q has no secret", key.ID)
+		}
+	}
+	return nil
+}
+
+// ParseKeys parses a comma separated list of id:secret pairs, current key
+// first, such as "2019-12:new-secret,:old-secret". The keys are validated.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("hash: key %q is not in the form id:secret",
+				pair)
+		}
+		keys = append(keys, Key{ID: pair[:i], Secret: pair[i+1:]})
+	}
+	if err := ValidateKeys(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,42 @@
+package imaging
+
+import "image"
+
+// Orient returns src transformed so that it displays upright for the given
+// EXIF orientation value (1-8). Unknown values return src unchanged.
+func Orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	in := toNRGBA(src)
+	w, h := in.Rect.Dx(), in.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally.
+				sx, sy = w-1-dx, dy
+			case 3: // Rotated 180 degrees.
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // Mirrored vertically.
+				sx, sy = dx, h-1-dy
+			case 5: // Mirrored along the top-left to bottom-right diagonal.
+				sx, sy = dy, dx
+			case 6: // Needs a 90 degree clockwise rotation.
+				sx, sy = dy, h-1-dx
+			case 7: // Mirrored along the top-right to bottom-left diagonal.
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // Needs a 90 degree counter-clockwise rotation.
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4],
+				in.Pix[sy*in.Stride+sx*4:sy*in.Stride+sx*4+4])
+		}
+	}
+	return dst
+}
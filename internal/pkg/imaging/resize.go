@@ -0,0 +1,115 @@
+// Package imaging provides the small set of image manipulations needed to
+// generate resized variants of uploaded photos.
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Fit returns the dimensions of a w x h image scaled down so that neither
+// side is longer than max, preserving the aspect ratio. Images that already
+// fit are returned unchanged.
+func Fit(w, h, max int) (int, int) {
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w >= h {
+		return max, scale(h, max, w)
+	}
+	return scale(w, max, h), max
+}
+
+func scale(n, num, den int) int {
+	v := (n*num + den/2) / den
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// Resize scales src down to w x h using a box filter, averaging every source
+// pixel that falls within a destination pixel. It is meant for downscaling;
+// upscaling works but is equivalent to nearest neighbour.
+func Resize(src image.Image, w, h int) *image.NRGBA {
+	in := toNRGBA(src)
+	sw, sh := in.Rect.Dx(), in.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if sw == 0 || sh == 0 || w == 0 || h == 0 {
+		return dst
+	}
+
+	// Each destination row is built from the strip of source rows it
+	// covers: every source row is scaled horizontally and summed into acc,
+	// so only one row of intermediate values is held at a time.
+	acc := make([]uint64, w*4)
+	for y := 0; y < h; y++ {
+		y0, y1 := span(y, sh, h)
+		for i := range acc {
+			acc[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			row := in.Pix[sy*in.Stride:]
+			for x := 0; x < w; x++ {
+				x0, x1 := span(x, sw, w)
+				var r, g, b, a uint64
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4:]
+					alpha := uint64(p[3])
+					r += uint64(p[0]) * alpha
+					g += uint64(p[1]) * alpha
+					b += uint64(p[2]) * alpha
+					a += alpha
+				}
+				n := uint64(x1 - x0)
+				i := x * 4
+				acc[i] += r / n
+				acc[i+1] += g / n
+				acc[i+2] += b / n
+				acc[i+3] += a * 255 / n
+			}
+		}
+		for x := 0; x < w; x++ {
+			i := x * 4
+			r, g, b, a := acc[i], acc[i+1], acc[i+2], acc[i+3]
+			p := dst.Pix[y*dst.Stride+x*4:]
+			if a == 0 {
+				p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+				continue
+			}
+			// Colour channels were weighted by alpha (0-255) while a was
+			// scaled by 255, so dividing by a yields the un-premultiplied
+			// colour.
+			p[0] = uint8(r * 255 / a)
+			p[1] = uint8(g * 255 / a)
+			p[2] = uint8(b * 255 / a)
+			p[3] = uint8(a / 255 / uint64(y1-y0))
+		}
+	}
+	return dst
+}
+
+// span returns the range of source pixels [lo, hi) covered by destination
+// pixel i when scaling n source pixels to m destination pixels. The range is
+// never empty.
+func span(i, n, m int) (int, int) {
+	lo := i * n / m
+	hi := (i + 1) * n / m
+	if hi <= lo {
+		hi = lo + 1
+	}
+	if hi > n {
+		hi = n
+	}
+	return lo, hi
+}
+
+func toNRGBA(src image.Image) *image.NRGBA {
+	if img, ok := src.(*image.NRGBA); ok && img.Rect.Min == (image.Point{}) {
+		return img
+	}
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+	return dst
+}
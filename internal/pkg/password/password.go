@@ -0,0 +1,279 @@
+// Package password hashes passwords according to a configurable policy.
+//
+// Hashes are stored in self-describing formats, so a hash records the
+// algorithm and parameters it was made with:
+//
+//	$2a$10$...                                 bcrypt
+//	$argon2id$v=19$m=65536,t=1,p=4$salt$key    argon2id
+//
+// Any supported format can be compared against, whatever the current
+// policy. NeedsRehash reports when a stored hash was made under a different
+// policy so it can be replaced the next time the password is known.
+//
+// A Hasher adds a secret pepper to passwords before hashing them, and
+// records which pepper was used in front of the hash, as in "2019-12:$2a$...".
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithm names a password hashing algorithm.
+type Algorithm string
+
+// Supported algorithms.
+const (
+	Bcrypt   Algorithm = "bcrypt"
+	Argon2id Algorithm = "argon2id"
+)
+
+var (
+	// ErrMismatch is returned by Compare when the password does not match
+	// the hash.
+	ErrMismatch = errors.New("password: password does not match hash")
+	// ErrUnknownFormat is returned when a hash is not in a format this
+	// package understands.
+	ErrUnknownFormat = errors.New("password: unknown hash format")
+	// ErrUnknownPepper is returned when a hash was made with a pepper that
+	// is no longer configured.
+	ErrUnknownPepper = errors.New("password: hash uses an unknown pepper")
+)
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params follow the recommendation in RFC 9106 for
+// memory-constrained environments.
+var DefaultArgon2Params = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// Policy decides how new hashes are made.
+type Policy struct {
+	Algorithm  Algorithm
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultPolicy returns a policy that hashes with bcrypt at the default
+// cost, which is how passwords have always been hashed.
+func DefaultPolicy() Policy {
+	return Policy{
+		Algorithm:  Bcrypt,
+		BcryptCost: bcrypt.DefaultCost,
+		Argon2:     DefaultArgon2Params,
+	}
+}
+
+// Validate returns an error if the policy cannot be used to hash passwords.
+func (p Policy) Validate() error {
+	switch p.Algorithm {
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("password: bcrypt cost must be between %d and %d",
+				bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		a := p.Argon2
+		if a.Time < 1 || a.Memory < 8*uint32(a.Threads) || a.Threads < 1 {
+			return errors.New("password: argon2id needs time >= 1, " +
+				"threads >= 1 and memory >= 8 KiB per thread")
+		}
+		if a.SaltLen < 8 || a.KeyLen < 16 {
+			return errors.New("password: argon2id needs a salt of at least " +
+				"8 bytes and a key of at least 16 bytes")
+		}
+	default:
+		return fmt.Errorf("password: unknown algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Hash hashes the password with a random salt according to the policy.
+func (p Policy) Hash(password string) (string, error) {
+	switch p.Algorithm {
+	case Bcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case Argon2id:
+		salt := make([]byte, p.Argon2.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2.Time,
+			p.Argon2.Memory, p.Argon2.Threads, p.Argon2.KeyLen)
+		return encodeArgon2(p.Argon2, salt, key), nil
+	default:
+		return "", fmt.Errorf("password: unknown algorithm %q", p.Algorithm)
+	}
+}
+
+// NeedsRehash reports whether hash was made with a different algorithm or
+// different parameters than the policy would use now.
+func (p Policy) NeedsRehash(hash string) bool {
+	switch algorithmOf(hash) {
+	case Bcrypt:
+		if p.Algorithm != Bcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.BcryptCost
+	case Argon2id:
+		if p.Algorithm != Argon2id {
+			return true
+		}
+		params, _, key, err := decodeArgon2(hash)
+		if err != nil {
+			return true
+		}
+		want := p.Argon2
+		return params.Time != want.Time || params.Memory != want.Memory ||
+			params.Threads != want.Threads || uint32(len(key)) != want.KeyLen
+	default:
+		return true
+	}
+}
+
+// Compare returns nil if password matches hash, ErrMismatch if it does not,
+// or ErrUnknownFormat if hash cannot be read.
+func Compare(hash, password string) error {
+	switch algorithmOf(hash) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrMismatch
+		}
+		return err
+	case Argon2id:
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time,
+			params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// Hasher hashes peppered passwords according to a policy. The first pepper
+// is used for new hashes; older peppers are kept so existing hashes can
+// still be checked until they are rehashed.
+type Hasher struct {
+	Policy  Policy
+	Peppers []hash.Key
+}
+
+// Validate returns an error if the policy or the peppers are invalid.
+func (h Hasher) Validate() error {
+	if err := h.Policy.Validate(); err != nil {
+		return err
+	}
+	return hash.ValidateKeys(h.Peppers)
+}
+
+// Hash hashes the password with the current pepper.
+func (h Hasher) Hash(password string) (string, error) {
+	pepper := h.Peppers[0]
+	hashed, err := h.Policy.Hash(password + pepper.Secret)
+	if err != nil {
+		return "", err
+	}
+	return hash.JoinKeyID(pepper.ID, hashed), nil
+}
+
+// Compare is like the package level Compare, for hashes made by a Hasher.
+func (h Hasher) Compare(hashed, password string) error {
+	id, hashed := hash.SplitKeyID(hashed)
+	for _, pepper := range h.Peppers {
+		if pepper.ID == id {
+			return Compare(hashed, password+pepper.Secret)
+		}
+	}
+	return ErrUnknownPepper
+}
+
+// NeedsRehash reports whether hashed was made with an older pepper or does
+// not match the policy.
+func (h Hasher) NeedsRehash(hashed string) bool {
+	id, hashed := hash.SplitKeyID(hashed)
+	return id != h.Peppers[0].ID || h.Policy.NeedsRehash(hashed)
+}
+
+func algorithmOf(hash string) Algorithm {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	default:
+		return ""
+	}
+}
+
+// b64 is the unpadded standard base64 encoding used by the reference
+// argon2 implementation's string format.
+var b64 = base64.RawStdEncoding
+
+func encodeArgon2(p Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil ||
+		version != argon2.Version {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
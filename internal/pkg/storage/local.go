@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var _ Store = &Local{}
+
+// Local stores objects as files below Root on the local filesystem. URLs are
+// built by prepending BaseURL to the key, so the application is expected to
+// serve the objects under BaseURL.
+type Local struct {
+	Root    string
+	BaseURL string
+}
+
+// NewLocal returns a Local store rooted at root and served under baseURL.
+func NewLocal(root, baseURL string) *Local {
+	return &Local{
+		Root:    root,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Put writes r to the file for key, creating any missing directories.
+func (l *Local) Put(key string, r io.Reader, contentType string) error {
+	p := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return ErrExist
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+// Open opens the file for key.
+func (l *Local) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+// Delete removes the file for key.
+func (l *Local) Delete(key string) error {
+	err := os.Remove(l.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeletePrefix removes the directory for prefix and everything below it.
+// The prefix must name a directory, e.g. "galleries/1/".
+func (l *Local) DeletePrefix(prefix string) error {
+	return os.RemoveAll(l.path(prefix))
+}
+
+// URL returns BaseURL joined with the escaped key.
+func (l *Local) URL(key string) string {
+	u := url.URL{Path: l.BaseURL + "/" + cleanKey(key)}
+	return u.String()
+}
+
+// path converts key into a path below Root. Cleaning the key as an absolute
+// path first makes sure it can never climb out of Root.
+func (l *Local) path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(cleanKey(key)))
+}
+
+// cleanKey normalizes key and strips any ".." elements that would escape the
+// root of the store.
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
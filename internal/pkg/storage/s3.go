@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var _ Store = &S3{}
+
+// S3Config holds the settings needed to talk to an S3 compatible service
+// such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. "http://localhost:9000"
+	// for a local MinIO or "https://s3.us-east-1.amazonaws.com".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// BaseURL is prepended to keys when building object URLs. It defaults
+	// to "/images" so objects are served through the application, which
+	// checks who may see them. Point it at the bucket or a CDN in front of
+	// it only if every object may be public.
+	BaseURL string
+}
+
+// S3 stores objects in a bucket of an S3 compatible service. Requests use
+// path-style addressing and are signed with AWS Signature Version 4, so it
+// works with MinIO as well as AWS.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns an S3 store for the given configuration.
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 endpoint and bucket are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "/images"
+	}
+	u, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &S3{
+		cfg:      cfg,
+		endpoint: u,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// Put uploads r as the object for key. The If-None-Match header makes the
+// service refuse to overwrite an existing object.
+func (s *S3) Put(key string, r io.Reader, contentType string) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("If-None-Match", "*")
+	res, err := s.do("PUT", s.objectPath(key), nil, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrExist
+	default:
+		return s.responseError(res)
+	}
+}
+
+// Open downloads the object for key.
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	res, err := s.do("GET", s.objectPath(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotExist
+	default:
+		defer res.Body.Close()
+		return nil, s.responseError(res)
+	}
+}
+
+// Delete removes the object for key.
+func (s *S3) Delete(key string) error {
+	res, err := s.do("DELETE", s.objectPath(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s.responseError(res)
+	}
+}
+
+// DeletePrefix lists every object under prefix and deletes them one by one.
+// Like Local, it treats prefix as a directory: "galleries/1" covers
+// "galleries/1/a.jpg" but not "galleries/10/a.jpg".
+func (s *S3) DeletePrefix(prefix string) error {
+	keys, err := s.list(cleanKey(prefix) + "/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// URL returns BaseURL joined with the escaped key.
+func (s *S3) URL(key string) string {
+	return strings.TrimSuffix(s.cfg.BaseURL, "/") + "/" +
+		uriEncode(cleanKey(key), false)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) list(prefix string) ([]string, error) {
+	var keys []string
+	var token string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do("GET", "/"+s.cfg.Bucket, query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err := s.responseError(res)
+			res.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) objectPath(key string) string {
+	return "/" + s.cfg.Bucket + "/" + uriEncode(cleanKey(key), false)
+}
+
+// do sends a signed request. path must already be URI encoded.
+func (s *S3) do(method, path string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = ""
+	rawURL := u.String() + path
+	if len(query) > 0 {
+		rawURL += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, path, query, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (s *S3) sign(req *http.Request, path string, query url.Values,
+	body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3) responseError(res *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("storage: s3 %s %s: %s: %s", res.Request.Method,
+		res.Request.URL.Path, res.Status, bytes.TrimSpace(msg))
+}
+
+// canonicalQuery encodes query the way Signature Version 4 expects: sorted
+// by key with every component URI encoded.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes every byte except the RFC 3986 unreserved
+// characters. Slashes are only encoded when encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,34 @@
+// Package storage provides the backends used to store uploaded images.
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrNotExist is returned when an object does not exist in the store.
+	ErrNotExist = errors.New("storage: object does not exist")
+	// ErrExist is returned by Put when an object already exists under the
+	// given key.
+	ErrExist = errors.New("storage: object already exists")
+)
+
+// Store is implemented by every storage backend. Keys are slash separated
+// paths such as "galleries/1/abc.jpg" and never begin with a slash.
+type Store interface {
+	// Put stores the content read from r under key. Put never overwrites an
+	// existing object and returns ErrExist instead.
+	Put(key string, r io.Reader, contentType string) error
+	// Open returns a reader for the object stored under key. The caller must
+	// close it.
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Deleting an object that
+	// does not exist is not an error.
+	Delete(key string) error
+	// DeletePrefix removes every object below the directory prefix, that is
+	// whose key begins with prefix followed by a slash.
+	DeletePrefix(prefix string) error
+	// URL returns the URL the object stored under key can be requested from.
+	URL(key string) string
+}
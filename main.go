@@ -1,45 +1,65 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/matthewrankin/lenslocked/config"
 	"github.com/matthewrankin/lenslocked/controllers"
 	"github.com/matthewrankin/lenslocked/middleware"
 	"github.com/matthewrankin/lenslocked/models"
 
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "docker"
-	dbname   = "lenslocked_dev"
-)
-
 func main() {
+	flags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := flags.Load()
+	if err != nil {
+		panic(err)
+	}
 
-	// Create a DB connection string and then use it to create our model
-	// services.
-	dbInfo := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	services, err := models.NewServices(dbInfo)
+	// Create our model services using the database connection info.
+	opts, err := cfg.Services()
+	if err != nil {
+		panic(err)
+	}
+	services, err := models.NewServices(cfg.Database.ConnectionInfo(), opts...)
 	if err != nil {
 		panic(err)
 	}
 	defer services.Close()
 	services.AutoMigrate()
 
+	cookies := cfg.CookiePolicy()
+
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	usersC := controllers.NewUsers(services.User, services.Session,
+		services.Login, services.TwoFactor, cfg.EmailSender())
+	usersC.Cookie = cookies
+	usersC.Deleter = services
+	usersC.BaseURL = cfg.BaseURL
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image,
+		services.Login, r)
+	galleriesC.Cookie = cookies
+	if cfg.RequireVerified != nil {
+		actions := strings.Join(cfg.RequireVerified, ",")
+		galleriesC.RequireVerified, err = controllers.ParseVerifiedActions(actions)
+		if err != nil {
+			panic(err)
+		}
+	}
+	imagesC := controllers.NewImages(services.Gallery, services.Image)
 
 	userMw := middleware.User{
-		UserService: services.User,
+		UserService:    services.User,
+		SessionService: services.Session,
+		Cookie:         cookies,
 	}
 	requireUserMw := middleware.RequireUser{}
 	newGallery := requireUserMw.Apply(galleriesC.New)
@@ -52,7 +72,37 @@ func main() {
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
 	r.Handle("/login", usersC.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
+	r.Handle("/login/2fa", usersC.TwoFactorLoginView).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.LoginTwoFactor).Methods("POST")
+	r.HandleFunc("/logout",
+		requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/logout/all",
+		requireUserMw.ApplyFn(usersC.LogoutAll)).Methods("POST")
+	r.HandleFunc("/account",
+		requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account",
+		requireUserMw.ApplyFn(usersC.UpdateAccount)).Methods("POST")
+	r.HandleFunc("/account/password",
+		requireUserMw.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/account/2fa/setup",
+		requireUserMw.ApplyFn(usersC.SetupTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/enable",
+		requireUserMw.ApplyFn(usersC.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable",
+		requireUserMw.ApplyFn(usersC.DisableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/delete",
+		requireUserMw.ApplyFn(usersC.DeleteAccount)).Methods("POST")
+	r.HandleFunc("/account/sessions",
+		requireUserMw.ApplyFn(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(usersC.RevokeSession)).Methods("POST")
+	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
+	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.VerifyEmail).Methods("GET")
+	r.HandleFunc("/verify/resend",
+		requireUserMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
 
 	// Gallery routes
 	r.Handle("/galleries/new", newGallery).Methods("GET")
@@ -63,22 +113,63 @@ func main() {
 		Name(controllers.IndexGalleries)
 	r.HandleFunc("/galleries/{id:[0-9]+}",
 		galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Unlock).Methods("POST")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}",
+		galleriesC.ShowBySlug).Methods("GET").Name(controllers.ShowSlug)
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}", galleriesC.Unlock).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit",
 		requireUserMw.ApplyFn(galleriesC.Edit)).
 		Methods("GET").
 		Name(controllers.EditGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/update",
 		requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/password",
+		requireUserMw.ApplyFn(galleriesC.SetPassword)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share",
+		requireUserMw.ApplyFn(galleriesC.RegenerateLink)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete",
 		requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images",
 		requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
+		requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/link",
+		requireUserMw.ApplyFn(galleriesC.ImageLink)).Methods("POST")
 
 	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}",
+		imagesC.Show).Methods("GET")
 
 	// Start the server.
-	fmt.Println("Starting the server on :3000...")
-	http.ListenAndServe(":3000", userMw.Apply(r))
+	fmt.Printf("Starting the server on %s...\n", cfg.Addr())
+	// The CSRF auth key signs the CSRF cookie. Unless configured it is
+	// generated at startup, so forms rendered before a restart have to be
+	// reloaded.
+	csrfKey, err := cfg.CSRFKey()
+	if err != nil {
+		panic(err)
+	}
+	csrfMw := csrf.Protect(csrfKey,
+		csrf.Path("/"),
+		csrf.Domain(cookies.Domain),
+		csrf.Secure(cookies.Secure),
+		csrf.SameSite(csrfSameSite(cookies.SameSite)),
+		csrf.ErrorHandler(http.HandlerFunc(staticC.CSRFFailure)))
+	maxBytesMw := middleware.MaxBytes{N: cfg.Uploads.MaxRequestBytes}
+
+	http.ListenAndServe(cfg.Addr(), maxBytesMw.Apply(userMw.Apply(csrfMw(r))))
+}
+
+// csrfSameSite converts a SameSite mode to the csrf package's equivalent.
+func csrfSameSite(mode http.SameSite) csrf.SameSiteMode {
+	switch mode {
+	case http.SameSiteLaxMode:
+		return csrf.SameSiteLaxMode
+	case http.SameSiteStrictMode:
+		return csrf.SameSiteStrictMode
+	case http.SameSiteNoneMode:
+		return csrf.SameSiteNoneMode
+	default:
+		return csrf.SameSiteDefaultMode
+	}
 }
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBytes is the default limit on the size of a request body, which
+// for an upload may carry several images.
+const DefaultMaxBytes = 50 << 20 // 50 megabytes
+
+// MaxBytes limits request bodies to N bytes, or DefaultMaxBytes if N is
+// zero. It has to run before anything that reads the body, such as the CSRF
+// middleware, which parses forms (including multipart uploads) to find their
+// token. Handlers can tell a body that was cut off with BodyTooLarge.
+type MaxBytes struct {
+	N int64
+}
+
+// Apply applies the middleware to http.Handler interfaces.
+func (mw *MaxBytes) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn will return an http.HandlerFunc that limits the size of the request
+// body before calling next(w, r).
+func (mw *MaxBytes) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	n := mw.N
+	if n == 0 {
+		n = DefaultMaxBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, n)}
+		next(w, r)
+	})
+}
+
+// BodyTooLarge reports whether reading the request body failed because it
+// was over the limit set by MaxBytes.
+func BodyTooLarge(r *http.Request) bool {
+	body, ok := r.Body.(*maxBytesBody)
+	return ok && body.tooLarge
+}
+
+// maxBytesBody records when the body it wraps hits its limit, which code
+// that parses forms would otherwise hide or only report in its message.
+type maxBytesBody struct {
+	io.ReadCloser
+	tooLarge bool
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.tooLarge = true
+	}
+	return n, err
+}
@@ -2,16 +2,30 @@ package middleware
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/matthewrankin/lenslocked/context"
+	"github.com/matthewrankin/lenslocked/internal/pkg/cookie"
 	"github.com/matthewrankin/lenslocked/models"
 )
 
-// User middleware will lookup the current user via their remember_token cookie
-// using the UserService. If the user is found, they will be set on the request
-// context. Regardless, the next handler is always called.
+// sessionTouchInterval limits how often a session's last seen time is written
+// back to the database and its cookie renewed.
+const sessionTouchInterval = time.Minute
+
+// User middleware will lookup the current session via the remember_token
+// cookie using the SessionService, and the session's user via the
+// UserService. If both are found, they will be set on the request context.
+// Regardless, the next handler is always called.
+//
+// Sessions past their absolute or idle timeout are deleted and their cookie
+// cleared. Active sessions are renewed: their last seen time moves forward,
+// which slides the idle timeout, and the cookie is reissued under the Cookie
+// policy.
 type User struct {
 	models.UserService
+	models.SessionService
+	Cookie cookie.Policy
 }
 
 // Apply applies the middleware to http.Handler interfaces.
@@ -26,21 +40,40 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	// We want to return a dynamically created func(http.ResponseWriter,
 	// *http.Request) but we also need to convert it into an http.HandlerFunc
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("remember_token")
+		remember, err := r.Cookie("remember_token")
 		if err != nil {
 			next(w, r)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByToken(remember.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
+		if mw.SessionService.Expired(session) {
+			mw.SessionService.Delete(session.ID)
+			http.SetCookie(w, mw.Cookie.Expire("remember_token"))
+			next(w, r)
+			return
+		}
+		user, err := mw.UserService.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		if now := time.Now(); now.Sub(session.LastSeenAt) > sessionTouchInterval {
+			// Failing to record activity is no reason to fail the request.
+			if mw.SessionService.Touch(session, now) == nil {
+				http.SetCookie(w, mw.Cookie.New("remember_token",
+					remember.Value, session.ExpiresAt))
+			}
+		}
 		// Get the context from our request.
 		ctx := r.Context()
 		// Create a new context from the existing one that has our user stored in
 		// it with the private user key.
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		// Create a new request from the existing one with our context attached to
 		// it and assign it back to `r`.
 		r = r.WithContext(ctx)
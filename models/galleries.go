@@ -1,6 +1,14 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"fmt"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/password"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+
+	"github.com/jinzhu/gorm"
+)
 
 var _ GalleryDB = &galleryGorm{}
 
@@ -8,18 +16,75 @@ var _ GalleryDB = &galleryGorm{}
 const (
 	ErrUserIDRequired modelError = "models: user ID is required"
 	ErrTitleRequired  modelError = "models: title is required"
+	// ErrVisibilityInvalid is returned when a gallery's visibility is not
+	// one of the supported values.
+	ErrVisibilityInvalid modelError = "models: visibility must be private, unlisted, or public"
+)
+
+// Gallery visibility settings.
+const (
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be viewed by anyone who has the link
+	// containing the gallery's slug.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic = "public"
 )
 
+// gallerySlugBytes is the number of random bytes used for gallery slugs.
+const gallerySlugBytes = 12
+
 // Gallery models a gallery resource.
 type Gallery struct {
 	gorm.Model
-	UserID uint     `gorm:"not_null;index"`
-	Title  string   `gorm:"not_null"`
-	Images []string `gorm:"-"`
+	UserID     uint    `gorm:"not_null;index"`
+	Title      string  `gorm:"not_null"`
+	Visibility string  `gorm:"not null;default:'private'"`
+	Slug       string  `gorm:"unique_index"`
+	Images     []Image `gorm:"-"`
+	// Password, when set, is hashed into PasswordHash on create or update.
+	// Visitors other than the owner must enter it to see the gallery.
+	Password     string `gorm:"-"`
+	PasswordHash string
+}
+
+// Locked reports whether user, who may be nil, needs to enter the gallery's
+// password before seeing its contents.
+func (g *Gallery) Locked(user *User) bool {
+	if g.PasswordHash == "" {
+		return false
+	}
+	return user == nil || user.ID != g.UserID
+}
+
+// CanView reports whether user, who may be nil, is allowed to view the
+// gallery. Unlisted galleries are only viewable by visitors who know an
+// unguessable link to them, which the caller indicates with withLink; this is
+// either the gallery's slug or the random filename of one of its images.
+func (g *Gallery) CanView(user *User, withLink bool) bool {
+	if user != nil && user.ID == g.UserID {
+		return true
+	}
+	switch g.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityUnlisted:
+		return withLink
+	default:
+		return false
+	}
 }
 
 // GalleryService provides the interface the gallery service.
 type GalleryService interface {
+	// Unlock checks the password for a locked gallery and returns an access
+	// token proving the bearer knows it. If the password is wrong it returns
+	// ErrPasswordIncorrect.
+	Unlock(gallery *Gallery, password string) (string, error)
+	// HasAccess reports whether token is a valid access token for the
+	// gallery. Tokens are invalidated whenever the password changes.
+	HasAccess(gallery *Gallery, token string) bool
 	GalleryDB
 }
 
@@ -27,6 +92,7 @@ type GalleryService interface {
 // gallery.
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
@@ -47,6 +113,16 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ?", slug)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
 func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	var galleries []Gallery
 	db := gg.db.Where("user_id = ?", userID)
@@ -71,25 +147,72 @@ func (gg *galleryGorm) Delete(id uint) error {
 
 type galleryService struct {
 	GalleryDB
+	hmac hash.HMAC
+	pw   password.Hasher
 }
 
-// NewGalleryService creates a new GalleryService using the given db.
-func NewGalleryService(db *gorm.DB) GalleryService {
+// NewGalleryService creates a new GalleryService using the given db. Gallery
+// passwords are hashed with the given hasher.
+func NewGalleryService(db *gorm.DB, hmac hash.HMAC, pw password.Hasher) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
 			},
+			pw: pw,
 		},
+		hmac: hmac,
+		pw:   pw,
 	}
 }
 
+// Unlock does not rehash passwords on an outdated policy or pepper: access
+// tokens are derived from the hash, so replacing it would lock out every
+// visitor who already unlocked the gallery.
+func (gs *galleryService) Unlock(gallery *Gallery, pw string) (string, error) {
+	err := gs.pw.Compare(gallery.PasswordHash, pw)
+	switch err {
+	case nil:
+		return gs.accessToken(gallery), nil
+	case password.ErrMismatch:
+		return "", ErrPasswordIncorrect
+	default:
+		return "", err
+	}
+}
+
+func (gs *galleryService) HasAccess(gallery *Gallery, token string) bool {
+	if gallery.PasswordHash == "" {
+		return true
+	}
+	return gs.hmac.Equal(accessTokenMessage(gallery), token)
+}
+
+// accessToken derives the token from the password hash so that changing the
+// password revokes every token handed out for the old one.
+func (gs *galleryService) accessToken(gallery *Gallery) string {
+	return gs.hmac.Hash(accessTokenMessage(gallery))
+}
+
+func accessTokenMessage(gallery *Gallery) string {
+	return fmt.Sprintf("gallery:%d:%s", gallery.ID, gallery.PasswordHash)
+}
+
 type galleryValidator struct {
 	GalleryDB
+	pw password.Hasher
 }
 
 func (gv *galleryValidator) Create(gallery *Gallery) error {
-	err := runGalleryValFns(gallery, gv.userIDRequired, gv.titleRequired)
+	err := runGalleryValFns(
+		gallery,
+		gv.userIDRequired,
+		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.setSlugIfUnset,
+		gv.hashPassword,
+	)
 	if err != nil {
 		return err
 	}
@@ -101,6 +224,10 @@ func (gv *galleryValidator) Update(gallery *Gallery) error {
 		gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.setSlugIfUnset,
+		gv.hashPassword,
 	)
 	if err != nil {
 		return err
@@ -122,6 +249,51 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	switch g.Visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return nil
+	default:
+		return ErrVisibilityInvalid
+	}
+}
+
+// setSlugIfUnset gives the gallery a random slug. Galleries created before
+// slugs existed get one the next time they are updated.
+func (gv *galleryValidator) setSlugIfUnset(g *Gallery) error {
+	if g.Slug != "" {
+		return nil
+	}
+	slug, err := rand.String(gallerySlugBytes)
+	if err != nil {
+		return err
+	}
+	g.Slug = slug
+	return nil
+}
+
+// hashPassword hashes the gallery's password the same way user passwords
+// are hashed.
+func (gv *galleryValidator) hashPassword(g *Gallery) error {
+	if g.Password == "" {
+		return nil
+	}
+	hashed, err := gv.pw.Hash(g.Password)
+	if err != nil {
+		return err
+	}
+	g.PasswordHash = hashed
+	g.Password = ""
+	return nil
+}
+
 func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
 	if gallery.ID <= 0 {
 		return ErrIDInvalid
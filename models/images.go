@@ -1,65 +1,782 @@
 package models
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
-	"os"
-	"path/filepath"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/exif"
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/imaging"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+	"github.com/matthewrankin/lenslocked/internal/pkg/storage"
+
+	"github.com/jinzhu/gorm"
+)
+
+var _ ImageDB = &imageGorm{}
+
+// Error verbiage.
+const (
+	// ErrImageNotFound is returned when an image cannot be found for a
+	// gallery.
+	ErrImageNotFound modelError = "models: image not found"
+	// ErrGalleryIDRequired is returned when an image is created without the
+	// gallery it belongs to.
+	ErrGalleryIDRequired modelError = "models: gallery ID is required"
+	// ErrFilenameRequired is returned when an image is created without a
+	// filename.
+	ErrFilenameRequired modelError = "models: filename is required"
+	// ErrImageTypeInvalid is returned when the content of an uploaded image
+	// is not one of the accepted image formats.
+	ErrImageTypeInvalid modelError = "models: image must be a jpg, jpeg, or png"
+	// ErrImageTooLarge is returned when an uploaded image is larger than the
+	// maximum allowed size.
+	ErrImageTooLarge modelError = "models: image is larger than the maximum allowed size"
+	// ErrFilenameInvalid is returned when an image filename would reference a
+	// file outside of its gallery's image directory.
+	ErrFilenameInvalid modelError = "models: image filename is not valid"
+	// ErrImageUnreadable is returned when an uploaded image looks like an
+	// accepted type but cannot be decoded.
+	ErrImageUnreadable modelError = "models: image could not be read"
+	// ErrImageTooManyPixels is returned when an uploaded image's dimensions
+	// exceed the maximum number of pixels allowed.
+	ErrImageTooManyPixels modelError = "models: image dimensions are larger than the maximum allowed"
+
+	errImageKeyExhausted modelError = "models: unable to generate a unique image filename"
+)
+
+// DefaultMaxImageBytes is the default limit on the size of a single image.
+const DefaultMaxImageBytes = 10 << 20 // 10 megabytes
+
+// DefaultMaxImagePixels is the default limit on the width times the height
+// of a single image. A few megabytes of compressed image can declare far
+// more pixels than that, which would take gigabytes to decode.
+const DefaultMaxImagePixels = 50 * 1000 * 1000 // 50 megapixels
+
+// allowedImageTypes maps the sniffed content types we accept for uploads to
+// the file extension used when storing them.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// imageKeyBytes is the number of random bytes used for image storage keys.
+const imageKeyBytes = 12
+
+// Names of the resized variants generated for every image.
+const (
+	ImageThumb  = "thumb"
+	ImageMedium = "medium"
+	ImageLarge  = "large"
 )
 
+// imageVariantSizes lists the variants to generate along with the maximum
+// length of their longest edge, largest first so each variant can be resized
+// from the previous one.
+var imageVariantSizes = []struct {
+	Name string
+	Max  int
+}{
+	{ImageLarge, 2048},
+	{ImageMedium, 1024},
+	{ImageThumb, 320},
+}
+
+// jpegQuality is the quality used when encoding resized jpeg variants.
+const jpegQuality = 85
+
+// Image models an image stored in a Gallery. The metadata is stored in the
+// database, while the image itself is kept in the image store. Filename is
+// generated by the ImageService; the name the file was uploaded with is kept
+// in OriginalName. URL is filled in by the ImageService from the store.
+type Image struct {
+	gorm.Model
+	GalleryID    uint   `gorm:"not_null;index"`
+	Filename     string `gorm:"not_null"`
+	OriginalName string
+	Caption      string
+	Position     int
+	Size         int64
+	Width        int
+	Height       int
+	ContentType  string
+	Variants     []ImageVariant
+	URL          string `gorm:"-"`
+
+	// Metadata read from the image's EXIF data when it was uploaded.
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	Orientation  int
+}
+
+// Camera returns the make and model of the camera the image was taken with.
+// Many cameras repeat the make in the model, so it is only added when it is
+// missing.
+func (i *Image) Camera() string {
+	if i.CameraMake == "" || strings.HasPrefix(strings.ToLower(i.CameraModel),
+		strings.ToLower(i.CameraMake)) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// Exposure summarizes the exposure settings, e.g. "50mm f/2.8 1/250s ISO 100".
+func (i *Image) Exposure() string {
+	var parts []string
+	if i.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", i.FocalLength))
+	}
+	if i.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", i.FNumber))
+	}
+	if i.ExposureTime != "" {
+		parts = append(parts, i.ExposureTime+"s")
+	}
+	if i.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", i.ISO))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setExif copies the useful EXIF fields onto the image.
+func (i *Image) setExif(d *exif.Data) {
+	i.CameraMake = d.Make
+	i.CameraModel = d.Model
+	i.LensModel = d.LensModel
+	i.ExposureTime = d.ExposureTime
+	i.FNumber = d.FNumber
+	i.ISO = d.ISO
+	i.FocalLength = d.FocalLength
+	i.Orientation = d.Orientation
+	if !d.TakenAt.IsZero() {
+		takenAt := d.TakenAt
+		i.TakenAt = &takenAt
+	}
+}
+
+// ImageVariant is a resized copy of an Image stored next to the original.
+// Variants are only generated when the original is larger than the variant's
+// size.
+type ImageVariant struct {
+	gorm.Model
+	ImageID  uint   `gorm:"not_null;index"`
+	Name     string `gorm:"not_null"`
+	Filename string `gorm:"not_null"`
+	Width    int
+	Height   int
+	Size     int64
+	URL      string `gorm:"-"`
+}
+
+// VariantURL returns the URL of the named variant. The original is returned
+// when the image was too small for that variant to be generated.
+func (i *Image) VariantURL(name string) string {
+	for _, v := range i.Variants {
+		if v.Name == name {
+			return v.URL
+		}
+	}
+	return i.URL
+}
+
+// SrcSet returns the value for an img srcset attribute listing every variant
+// and the original along with their widths.
+func (i *Image) SrcSet() string {
+	var parts []string
+	for _, v := range i.Variants {
+		parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	if i.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.URL, i.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Key returns the key the image is stored under in the image store.
+func (i *Image) Key() string {
+	return galleryPrefix(i.GalleryID) + i.Filename
+}
+
+// galleryPrefix returns the storage key prefix for all images in a gallery.
+func galleryPrefix(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v/", galleryID)
+}
+
+// variantKey returns the key a variant of this image is stored under.
+func (i *Image) variantKey(v *ImageVariant) string {
+	return galleryPrefix(i.GalleryID) + v.Filename
+}
+
 // ImageService provides the interface for the image service.
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
-	ByGalleryID(galleryID uint) ([]string, error)
+	Create(galleryID uint, r io.Reader, filename string) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	Update(image *Image) error
+	Delete(image *Image) error
+	DeleteByGalleryID(galleryID uint) error
+	// ByFile returns the image that filename, which may name the original or
+	// one of its variants, belongs to. It only reads the database, so callers
+	// can authorize the request before anything is read from the store.
+	ByFile(galleryID uint, filename string) (*Image, error)
+	// Open returns a reader for filename, the original image or one of its
+	// variants. The caller must close the reader.
+	Open(image *Image, filename string) (io.ReadCloser, error)
+	// SignURL returns the URL of the image with a signature appended that
+	// authorizes the request until expires, even if the gallery is private.
+	SignURL(image *Image, expires time.Time) string
+	// CheckSignature reports whether signature is a valid signature for the
+	// image that has not expired. expires is the Unix time the URL was
+	// signed to expire at.
+	CheckSignature(image *Image, expires int64, signature string) bool
+}
+
+// ImageDB provides the interface for interacting with the database for an
+// image.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+}
+
+// ImageConfig controls how the image service processes uploads.
+type ImageConfig struct {
+	// MaxBytes is the largest image, in bytes, that will be accepted.
+	MaxBytes int64
+	// MaxPixels is the most pixels, width times height, an image may have.
+	// It is checked before the image is decoded.
+	MaxPixels int64
+	// KeepMetadata serves images with their embedded EXIF and XMP metadata,
+	// including any GPS location, intact. By default it is stripped from the
+	// stored image once the useful fields have been recorded.
+	KeepMetadata bool
+}
+
+// NewImageService returns a new image service that records metadata in db
+// and stores the images themselves in store. Image links are signed with
+// hmac.
+func NewImageService(db *gorm.DB, hmac hash.HMAC, store storage.Store, cfg ImageConfig) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{
+				db: db,
+			},
+		},
+		store: store,
+		cfg:   cfg,
+		hmac:  hmac,
+	}
 }
 
-// NewImageService returns a new image service.
-func NewImageService() ImageService {
-	return &imageService{}
+type imageService struct {
+	ImageDB
+	store storage.Store
+	cfg   ImageConfig
+	hmac  hash.HMAC
 }
 
-type imageService struct{}
+// Create stores the image read from r in the image store and records its
+// metadata in the database. The content of r is sniffed to make sure it is an
+// accepted image type, and it must not be larger than the service's size
+// limit. The image is stored under a newly generated filename; the given
+// filename is only kept as metadata.
+//
+// EXIF data is recorded on the image and its orientation applied, and unless
+// the service is configured to keep it, the metadata is stripped from the
+// stored copy so that we never serve the photographer's location.
+func (is *imageService) Create(galleryID uint, r io.Reader, filename string) (*Image, error) {
+	// Read one byte past the limit so we can tell when it was exceeded.
+	data, err := ioutil.ReadAll(io.LimitReader(r, is.cfg.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > is.cfg.MaxBytes {
+		return nil, ErrImageTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedImageTypes[contentType]
+	if !ok {
+		return nil, ErrImageTypeInvalid
+	}
+	existing, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
 
-func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
-	path, err := is.mkImagePath(galleryID)
+	img := Image{
+		GalleryID:    galleryID,
+		OriginalName: sanitizeFilename(filename),
+		Position:     len(existing),
+		ContentType:  contentType,
+	}
+	// Check the dimensions in the header before decoding allocates memory
+	// for every pixel.
+	dims, _, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, ErrImageUnreadable
+	}
+	if dims.Width <= 0 || dims.Height <= 0 {
+		return nil, ErrImageUnreadable
+	}
+	if int64(dims.Width)*int64(dims.Height) > is.cfg.MaxPixels {
+		return nil, ErrImageTooManyPixels
 	}
-	dst, err := os.Create(filepath.Join(path, filename))
+	src, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, ErrImageUnreadable
+	}
+	if meta, err := exif.Decode(data); err == nil {
+		img.setExif(meta)
+	}
+	if img.Orientation > 1 {
+		src = imaging.Orient(src, img.Orientation)
+	}
+	img.Width = src.Bounds().Dx()
+	img.Height = src.Bounds().Dy()
+	if !is.cfg.KeepMetadata {
+		data, err = is.stripMetadata(&img, src, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	img.Size = int64(len(data))
+	if err := is.putUnique(&img, ext, data); err != nil {
+		return nil, err
+	}
+	if err := is.createVariants(&img, src, ext); err != nil {
+		is.deleteFiles(&img)
+		return nil, err
+	}
+	if err := is.ImageDB.Create(&img); err != nil {
+		is.deleteFiles(&img)
+		return nil, err
+	}
+	is.setURL(&img)
+	return &img, nil
+}
+
+// ByGalleryID returns the images for the given gallery with their URLs set.
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		is.setURL(&images[i])
+	}
+	return images, nil
+}
+
+// ByFilename returns the image with the given filename with its URL set.
+func (is *imageService) ByFilename(galleryID uint, filename string) (*Image, error) {
+	img, err := is.ImageDB.ByFilename(galleryID, filename)
+	if err != nil {
+		return nil, err
+	}
+	is.setURL(img)
+	return img, nil
+}
+
+func (is *imageService) ByFile(galleryID uint, filename string) (*Image, error) {
+	img, err := is.ByFilename(galleryID, filename)
+	if err == ErrImageNotFound {
+		img, err = is.byVariantFilename(galleryID, filename)
+	}
+	return img, err
+}
+
+func (is *imageService) Open(image *Image, filename string) (io.ReadCloser, error) {
+	if !image.hasFile(filename) {
+		return nil, ErrImageNotFound
+	}
+	rc, err := is.store.Open(galleryPrefix(image.GalleryID) + filename)
+	if err == storage.ErrNotExist {
+		return nil, ErrImageNotFound
+	}
+	return rc, err
+}
+
+func (is *imageService) SignURL(image *Image, expires time.Time) string {
+	exp := expires.Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(exp, 10))
+	query.Set("signature", is.hmac.Hash(signedImageMessage(image, exp)))
+	return image.URL + "?" + query.Encode()
+}
+
+func (is *imageService) CheckSignature(image *Image, expires int64, signature string) bool {
+	if time.Now().Unix() > expires {
+		return false
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, r)
+	return is.hmac.Equal(signedImageMessage(image, expires), signature)
+}
+
+// signedImageMessage is the message signed for a signed image URL. It covers
+// the image rather than a single file, so the signature also works for the
+// image's variants.
+func signedImageMessage(image *Image, expires int64) string {
+	return fmt.Sprintf("image:%d:%d:%d", image.GalleryID, image.ID, expires)
+}
+
+// byVariantFilename finds the image a variant filename such as
+// "abc_thumb.jpg" was generated from.
+func (is *imageService) byVariantFilename(galleryID uint, filename string) (*Image, error) {
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	i := strings.LastIndex(base, "_")
+	if i < 0 {
+		return nil, ErrImageNotFound
+	}
+	img, err := is.ByFilename(galleryID, base[:i]+ext)
 	if err != nil {
+		return nil, err
+	}
+	if !img.hasFile(filename) {
+		return nil, ErrImageNotFound
+	}
+	return img, nil
+}
+
+// hasFile reports whether filename is the image or one of its variants.
+func (i *Image) hasFile(filename string) bool {
+	if filename == i.Filename {
+		return true
+	}
+	for _, v := range i.Variants {
+		if v.Filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes the given image and its variants from the image store and
+// from the database.
+func (is *imageService) Delete(image *Image) error {
+	if !validFilename(image.Filename) {
+		return ErrFilenameInvalid
+	}
+	if err := is.deleteFiles(image); err != nil {
+		return err
+	}
+	return is.ImageDB.Delete(image.ID)
+}
+
+// DeleteByGalleryID removes every image stored for the given gallery.
+func (is *imageService) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	if err := is.store.DeletePrefix(galleryPrefix(galleryID)); err != nil {
 		return err
 	}
+	return is.ImageDB.DeleteByGalleryID(galleryID)
+}
+
+// putUnique stores data under a random filename with the given extension and
+// sets img.Filename to it. The store never overwrites an existing image; on
+// the off chance of a collision we simply try another filename.
+func (is *imageService) putUnique(img *Image, ext string, data []byte) error {
+	for i := 0; i < 5; i++ {
+		token, err := rand.String(imageKeyBytes)
+		if err != nil {
+			return err
+		}
+		img.Filename = token + ext
+		err = is.store.Put(img.Key(), bytes.NewReader(data), img.ContentType)
+		if err == storage.ErrExist {
+			continue
+		}
+		return err
+	}
+	return errImageKeyExhausted
+}
+
+// createVariants generates and stores every variant that is smaller than the
+// original, adding them to img.Variants.
+func (is *imageService) createVariants(img *Image, src image.Image, ext string) error {
+	base := strings.TrimSuffix(img.Filename, ext)
+	for _, size := range imageVariantSizes {
+		if img.Width <= size.Max && img.Height <= size.Max {
+			continue
+		}
+		w, h := imaging.Fit(img.Width, img.Height, size.Max)
+		resized := imaging.Resize(src, w, h)
+		buf, err := encodeImage(resized, img.ContentType)
+		if err != nil {
+			return err
+		}
+		v := ImageVariant{
+			Name:     size.Name,
+			Filename: base + "_" + size.Name + ext,
+			Width:    w,
+			Height:   h,
+			Size:     int64(buf.Len()),
+		}
+		err = is.store.Put(img.variantKey(&v), buf, img.ContentType)
+		if err != nil {
+			return err
+		}
+		img.Variants = append(img.Variants, v)
+		// Resize the next, smaller variant from this one; it is much
+		// cheaper than starting from the original every time.
+		src = resized
+	}
 	return nil
 }
 
-// ByGalleryID returns all the image paths for the given gallery ID.
-func (is *imageService) ByGalleryID(galleryID uint) ([]string, error) {
-	path := is.imagePath(galleryID)
-	strings, err := filepath.Glob(filepath.Join(path, "*"))
+// stripMetadata returns the copy of an uploaded image we store and serve. The
+// embedded metadata is dropped without touching the image data, unless the
+// image had to be rotated upright, in which case it is re-encoded from src.
+func (is *imageService) stripMetadata(img *Image, src image.Image, data []byte) ([]byte, error) {
+	if img.Orientation <= 1 {
+		return exif.Strip(data), nil
+	}
+	buf, err := encodeImage(src, img.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeImage encodes src in the given format, jpeg unless it is png.
+func encodeImage(src image.Image, contentType string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(&buf, src)
+	} else {
+		err = jpeg.Encode(&buf, src, &jpeg.Options{Quality: jpegQuality})
+	}
+	return &buf, err
+}
+
+// deleteFiles removes the image and all of its variants from the store.
+func (is *imageService) deleteFiles(img *Image) error {
+	for i := range img.Variants {
+		if err := is.store.Delete(img.variantKey(&img.Variants[i])); err != nil {
+			return err
+		}
+	}
+	return is.store.Delete(img.Key())
+}
+
+func (is *imageService) setURL(img *Image) {
+	img.URL = is.store.URL(img.Key())
+	for i := range img.Variants {
+		img.Variants[i].URL = is.store.URL(img.variantKey(&img.Variants[i]))
+	}
+}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.withVariants().Where("id = ?", id)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID returns all the images for the given gallery ID in the order
+// they should be displayed.
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.withVariants().Where("gallery_id = ?", galleryID).
+		Order("position, id")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.withVariants().
+		Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &image)
+	if err == ErrNotFound {
+		return nil, ErrImageNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	// Add a leading "/" to all image file paths
-	for i := range strings {
-		strings[i] = "/" + strings[i]
+	return &image, nil
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+func (ig *imageGorm) Delete(id uint) error {
+	err := ig.db.Where("image_id = ?", id).Delete(&ImageVariant{}).Error
+	if err != nil {
+		return err
+	}
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Delete(&image).Error
+}
+
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	images := ig.db.Table("images").Select("id").
+		Where("gallery_id = ?", galleryID).QueryExpr()
+	err := ig.db.Where("image_id IN (?)", images).
+		Delete(&ImageVariant{}).Error
+	if err != nil {
+		return err
+	}
+	return ig.db.Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+}
+
+// withVariants preloads the variants of the queried images, smallest first.
+func (ig *imageGorm) withVariants() *gorm.DB {
+	return ig.db.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("width")
+	})
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+// ByFilename rejects filenames that could reference a file outside of the
+// gallery's image directory before looking the image up.
+func (iv *imageValidator) ByFilename(galleryID uint, filename string) (*Image, error) {
+	if !validFilename(filename) {
+		return nil, ErrFilenameInvalid
 	}
-	return strings, nil
+	return iv.ImageDB.ByFilename(galleryID, filename)
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFns(
+		image,
+		iv.galleryIDRequired,
+		iv.filenameRequired,
+		iv.filenameSafe,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
-	err := os.MkdirAll(galleryPath, 0755)
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFns(
+		image,
+		iv.nonZeroID,
+		iv.galleryIDRequired,
+		iv.filenameRequired,
+		iv.filenameSafe,
+	)
 	if err != nil {
-		return "", err
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	var image Image
+	image.ID = id
+	if err := runImageValFns(&image, iv.nonZeroID); err != nil {
+		return err
+	}
+	return iv.ImageDB.Delete(image.ID)
+}
+
+func (iv *imageValidator) galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameRequired(i *Image) error {
+	if i.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameSafe(i *Image) error {
+	if !validFilename(i.Filename) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) nonZeroID(i *Image) error {
+	if i.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+type imageValFn func(*Image) error
+
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validFilename reports whether name refers to a file directly inside a
+// gallery's image directory.
+func validFilename(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`) && !strings.ContainsRune(name, 0)
+}
+
+// sanitizeFilename strips any directory components and control characters
+// from a client supplied filename so it is safe to display.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[:255])
 	}
-	return galleryPath, nil
+	return name
 }
@@ -0,0 +1,88 @@
+package models
+
+import "fmt"
+
+// keyIDExpr extracts the key ID from a hash column, following
+// hash.SplitKeyID: everything before the first colon, or nothing if there is
+// no colon.
+const keyIDExpr = "CASE WHEN position(':' in %[1]s) > 0 " +
+	"THEN split_part(%[1]s, ':', 1) ELSE '' END"
+
+// keyedColumns are the stored hashes that record the ID of the key they were
+// made with: HMAC keys for tokens and recovery codes, peppers for passwords.
+var keyedColumns = []struct {
+	table, column string
+	pepper        bool
+}{
+	{"sessions", "token_hash", false},
+	{"pw_resets", "token_hash", false},
+	{"recovery_codes", "code_hash", false},
+	{"users", "password_hash", true},
+	{"galleries", "password_hash", true},
+}
+
+// KeyUse is the number of hashes in a column made with one key.
+type KeyUse struct {
+	Table  string
+	Column string
+	// Pepper is true for password hashes, whose key is a pepper, and false
+	// for HMAC hashes.
+	Pepper bool
+	KeyID  string
+	Count  int
+}
+
+// KeyUsage counts the stored hashes made with each HMAC key and pepper. A key
+// can be removed from the configuration once nothing uses it.
+func (s *Services) KeyUsage() ([]KeyUse, error) {
+	var usage []KeyUse
+	for _, c := range keyedColumns {
+		expr := keyIDOf(c.column)
+		rows, err := s.db.Unscoped().Table(c.table).
+			Select(expr + " AS key_id, count(*)").
+			Where(c.column + " <> ''").
+			Group(expr).Order("key_id").Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			use := KeyUse{Table: c.table, Column: c.column, Pepper: c.pepper}
+			if err := rows.Scan(&use.KeyID, &use.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			usage = append(usage, use)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// RevokeSessionsByKey deletes up to limit sessions whose remember token hash
+// was made with the given HMAC key, and reports how many were deleted.
+// Password reset tokens made with the key are deleted too. Sessions are
+// rekeyed when used, so this is only needed for those not used since the key
+// was rotated.
+func (s *Services) RevokeSessionsByKey(keyID string, limit int) (int64, error) {
+	where := keyIDOf("token_hash") + " = ?"
+	err := s.db.Unscoped().Where(where, keyID).Delete(&pwReset{}).Error
+	if err != nil {
+		return 0, err
+	}
+	var ids []uint
+	err = s.db.Model(&Session{}).Where(where, keyID).Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	res := s.db.Unscoped().Where("id IN (?)", ids).Delete(&Session{})
+	return res.RowsAffected, res.Error
+}
+
+func keyIDOf(column string) string {
+	return fmt.Sprintf(keyIDExpr, column)
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrLoginThrottled is returned when a login is attempted for an account,
+	// or from an IP address, with too many recent failed attempts.
+	ErrLoginThrottled modelError = "models: too many failed login attempts. Please wait a few minutes and try again"
+	// ErrUnlockThrottled is returned when a gallery password is tried for a
+	// gallery, or from an IP address, with too many recent wrong guesses.
+	ErrUnlockThrottled modelError = "models: too many incorrect passwords. Please wait a few minutes and try again"
+	// ErrResetThrottled is returned when password resets are requested for
+	// an email address, or from an IP address, too often.
+	ErrResetThrottled modelError = "models: too many password reset requests. Please wait a few minutes and try again"
+)
+
+// throttlePolicy describes how quickly failed logins lock out a key. The
+// first free failures cost nothing; each one after that doubles the time
+// the key is locked for, starting at base, up to max.
+type throttlePolicy struct {
+	free int
+	base time.Duration
+	max  time.Duration
+}
+
+var (
+	// Accounts are locked for up to an hour after repeated failures.
+	accountThrottle = throttlePolicy{free: 4, base: 30 * time.Second, max: time.Hour}
+	// Many users can share an IP address, so IPs are allowed more failures.
+	ipThrottle = throttlePolicy{free: 20, base: 30 * time.Second, max: time.Hour}
+	// throttleForget is how long after the last failure a key starts over.
+	// Its row is deleted then, so keys that are never used again, such as
+	// made up email addresses, do not pile up.
+	throttleForget = 24 * time.Hour
+)
+
+// lockout returns how long a key is locked for after its nth failure.
+func (p throttlePolicy) lockout(failures int) time.Duration {
+	if failures <= p.free {
+		return 0
+	}
+	d := p.base
+	for i := p.free + 1; i < failures && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+// loginThrottle records failed logins for an account or IP address. Rows
+// are kept in the database so lockouts survive restarts.
+type loginThrottle struct {
+	gorm.Model
+	Key           string    `gorm:"not null;unique_index"`
+	Failures      int       `gorm:"not null;default:0"`
+	LastFailureAt time.Time `gorm:"index"`
+	LockedUntil   time.Time
+}
+
+// LoginThrottleService limits login attempts per account and per IP
+// address.
+type LoginThrottleService interface {
+	// Check returns ErrLoginThrottled if either the account with the email
+	// address or the IP address is locked out.
+	Check(ip, email string) error
+	// Failed records a failed login for both the account and IP address.
+	Failed(ip, email string) error
+	// Succeeded clears the failures recorded for the account. Failures from
+	// the IP address are kept, so signing in to an account of one's own
+	// does not reset them.
+	Succeeded(email string) error
+	// Forget removes everything recorded for the email address.
+	Forget(email string) error
+
+	// CheckGallery returns ErrUnlockThrottled if either the gallery or the
+	// IP address is locked out.
+	CheckGallery(ip string, galleryID uint) error
+	// FailedGallery records a wrong gallery password for both the gallery
+	// and IP address.
+	FailedGallery(ip string, galleryID uint) error
+	// SucceededGallery clears the failures recorded for the gallery.
+	SucceededGallery(galleryID uint) error
+
+	// CheckReset returns ErrResetThrottled if either the email address or
+	// the IP address has requested too many password resets.
+	CheckReset(ip, email string) error
+	// ResetRequested records a password reset request for both the email
+	// address and IP address, whether or not an account uses the email
+	// address.
+	ResetRequested(ip, email string) error
+}
+
+type loginThrottleService struct {
+	db *gorm.DB
+}
+
+// NewLoginThrottleService creates a new LoginThrottleService.
+func NewLoginThrottleService(db *gorm.DB) LoginThrottleService {
+	return &loginThrottleService{db}
+}
+
+func (lts *loginThrottleService) Check(ip, email string) error {
+	locked, err := lts.locked(ipKey(ip), emailKey(email))
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrLoginThrottled
+	}
+	return nil
+}
+
+func (lts *loginThrottleService) Failed(ip, email string) error {
+	if err := lts.fail(ipKey(ip), ipThrottle); err != nil {
+		return err
+	}
+	return lts.fail(emailKey(email), accountThrottle)
+}
+
+func (lts *loginThrottleService) Succeeded(email string) error {
+	return lts.Forget(email)
+}
+
+func (lts *loginThrottleService) Forget(email string) error {
+	return lts.forget(emailKey(email))
+}
+
+func (lts *loginThrottleService) CheckGallery(ip string, galleryID uint) error {
+	locked, err := lts.locked(ipKey(ip), galleryKey(galleryID))
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrUnlockThrottled
+	}
+	return nil
+}
+
+// FailedGallery counts towards the same IP address lockout as failed
+// logins, so guessing gallery passwords and account passwords share one
+// budget.
+func (lts *loginThrottleService) FailedGallery(ip string, galleryID uint) error {
+	if err := lts.fail(ipKey(ip), ipThrottle); err != nil {
+		return err
+	}
+	return lts.fail(galleryKey(galleryID), accountThrottle)
+}
+
+func (lts *loginThrottleService) SucceededGallery(galleryID uint) error {
+	return lts.forget(galleryKey(galleryID))
+}
+
+func (lts *loginThrottleService) CheckReset(ip, email string) error {
+	locked, err := lts.locked(resetKey(ipKey(ip)), resetKey(emailKey(email)))
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrResetThrottled
+	}
+	return nil
+}
+
+// ResetRequested counts separately from failed logins, so requesting resets
+// for someone's address does not lock them out of signing in.
+func (lts *loginThrottleService) ResetRequested(ip, email string) error {
+	if err := lts.fail(resetKey(ipKey(ip)), ipThrottle); err != nil {
+		return err
+	}
+	return lts.fail(resetKey(emailKey(email)), accountThrottle)
+}
+
+// prune deletes the rows of keys with no failure within throttleForget. As
+// lockouts are shorter than that, none of them is still locked.
+func (lts *loginThrottleService) prune(now time.Time) error {
+	return lts.db.Unscoped().
+		Where("last_failure_at < ? AND locked_until < ?",
+			now.Add(-throttleForget), now).
+		Delete(&loginThrottle{}).Error
+}
+
+// locked reports whether any of the keys is locked out.
+func (lts *loginThrottleService) locked(keys ...string) (bool, error) {
+	var locked int
+	err := lts.db.Model(&loginThrottle{}).
+		Where("key IN (?) AND locked_until > ?", keys, time.Now()).
+		Count(&locked).Error
+	return locked > 0, err
+}
+
+// forget removes everything recorded for the key.
+func (lts *loginThrottleService) forget(key string) error {
+	return lts.db.Unscoped().Where("key = ?", key).
+		Delete(&loginThrottle{}).Error
+}
+
+// fail records a failure for the key and locks it according to policy. Rows
+// of keys whose failures have been forgotten are pruned first.
+func (lts *loginThrottleService) fail(key string, policy throttlePolicy) error {
+	now := time.Now()
+	if err := lts.prune(now); err != nil {
+		return err
+	}
+	var lt loginThrottle
+	err := lts.db.Where(loginThrottle{Key: key}).FirstOrCreate(&lt).Error
+	if err != nil {
+		return err
+	}
+	// Count in the database so concurrent failures are not lost. Old
+	// failures are forgotten.
+	err = lts.db.Model(&lt).Updates(map[string]interface{}{
+		"failures": gorm.Expr(
+			"CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END",
+			now.Add(-throttleForget)),
+		"last_failure_at": now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if err := lts.db.First(&lt, lt.ID).Error; err != nil {
+		return err
+	}
+	if d := policy.lockout(lt.Failures); d > 0 {
+		return lts.db.Model(&lt).Update("locked_until", now.Add(d)).Error
+	}
+	return nil
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.TrimSpace(strings.ToLower(email))
+}
+
+func resetKey(key string) string {
+	return "reset:" + key
+}
+
+func galleryKey(galleryID uint) string {
+	return fmt.Sprintf("gallery:%d", galleryID)
+}
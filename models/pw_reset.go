@@ -0,0 +1,141 @@
+package models
+
+import (
+	"time"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrTokenInvalid is returned when a password reset token is unknown,
+	// already used or expired.
+	ErrTokenInvalid modelError = "models: token provided is not valid"
+
+	// pwResetDuration is how long a password reset token can be used for.
+	pwResetDuration = 12 * time.Hour
+)
+
+// pwReset is a single-use token allowing a user to set a new password. Like
+// remember tokens only its HMAC hash is stored.
+type pwReset struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type pwResetDB interface {
+	ByToken(token string) (*pwReset, error)
+	Create(pwr *pwReset) error
+	Delete(id uint) error
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
+	var pwr pwReset
+	err := first(pwrg.db.Where("token_hash = ?", tokenHash), &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// Delete removes the token for good so it cannot be used twice.
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	pwr := pwReset{Model: gorm.Model{ID: id}}
+	return pwrg.db.Unscoped().Delete(&pwr).Error
+}
+
+type pwResetValidator struct {
+	pwResetDB
+	hmac hash.HMAC
+}
+
+func newPwResetValidator(db pwResetDB, hmac hash.HMAC) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		hmac:      hmac,
+	}
+}
+
+// ByToken tries the token's hash under each HMAC key in turn, so tokens
+// sent out before a key rotation keep working.
+func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	for _, tokenHash := range pwrv.hmac.Hashes(token) {
+		pwr, err := pwrv.pwResetDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return pwr, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
+	err := runPwResetValFns(pwr,
+		pwrv.requireUserID,
+		pwrv.setTokenIfUnset,
+		pwrv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pwrv.pwResetDB.Delete(id)
+}
+
+type pwResetValFn func(*pwReset) error
+
+func runPwResetValFns(pwr *pwReset, fns ...pwResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) requireUserID(pwr *pwReset) error {
+	if pwr.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *pwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
@@ -1,28 +1,154 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/password"
+	"github.com/matthewrankin/lenslocked/internal/pkg/storage"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ServicesConfig is a functional option used to configure the services
+// created by NewServices.
+type ServicesConfig func(*servicesConfig)
+
+type servicesConfig struct {
+	image      ImageConfig
+	imageStore storage.Store
+	session    SessionConfig
+	password   password.Policy
+	hmacKeys   []hash.Key
+	peppers    []hash.Key
+	logMode    bool
+}
+
+// WithMaxImageSize limits the size in bytes of a single uploaded image.
+func WithMaxImageSize(n int64) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.image.MaxBytes = n
+	}
+}
+
+// WithMaxImagePixels limits the width times the height of a single uploaded
+// image.
+func WithMaxImagePixels(n int64) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.image.MaxPixels = n
+	}
+}
+
+// WithImageMetadata keeps the EXIF and XMP metadata, including GPS location,
+// in the images we store and serve. By default it is stripped.
+func WithImageMetadata(keep bool) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.image.KeepMetadata = keep
+	}
+}
+
+// WithImageStore sets the backend uploaded images are stored in. By default
+// images are stored on the local filesystem below ./images.
+func WithImageStore(store storage.Store) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.imageStore = store
+	}
+}
+
+// WithSessionTimeouts sets how long sessions last after sign in (lifetime)
+// and without being used (idle). An idle timeout of zero disables it.
+func WithSessionTimeouts(lifetime, idle time.Duration) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.session = SessionConfig{Lifetime: lifetime, IdleTimeout: idle}
+	}
+}
+
+// WithPasswordPolicy sets how user and gallery passwords are hashed. Users
+// whose password was hashed under a different policy have it rehashed the
+// next time they sign in. By default passwords are hashed with bcrypt.
+func WithPasswordPolicy(policy password.Policy) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.password = policy
+	}
+}
+
+// WithLogMode logs every SQL statement when enabled, as it is by default.
+func WithLogMode(enable bool) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		cfg.logMode = enable
+	}
+}
+
+// WithKeys sets the keys remember tokens, reset tokens and signed links are
+// HMACed with, and the peppers added to passwords before hashing, current
+// key first. Older keys are only used to check what was made with them, and
+// can be removed once nothing uses them any more; see cmd/rekey. An empty
+// list keeps the development default.
+func WithKeys(hmacKeys, peppers []hash.Key) ServicesConfig {
+	return func(cfg *servicesConfig) {
+		if len(hmacKeys) > 0 {
+			cfg.hmacKeys = hmacKeys
+		}
+		if len(peppers) > 0 {
+			cfg.peppers = peppers
+		}
+	}
+}
 
 // NewServices creates all the services using the given connection info.
-func NewServices(connectionInfo string) (*Services, error) {
+func NewServices(connectionInfo string, cfgs ...ServicesConfig) (*Services, error) {
+	cfg := servicesConfig{
+		image: ImageConfig{
+			MaxBytes:  DefaultMaxImageBytes,
+			MaxPixels: DefaultMaxImagePixels,
+		},
+		imageStore: storage.NewLocal("images", "/images"),
+		session: SessionConfig{
+			Lifetime:    DefaultSessionLifetime,
+			IdleTimeout: DefaultSessionIdleTimeout,
+		},
+		password: password.DefaultPolicy(),
+		hmacKeys: []hash.Key{{Secret: hmacSecretKey}},
+		peppers:  []hash.Key{{Secret: userPwPepper}},
+		logMode:  true,
+	}
+	for _, fn := range cfgs {
+		fn(&cfg)
+	}
+	pw := password.Hasher{Policy: cfg.password, Peppers: cfg.peppers}
+	if err := pw.Validate(); err != nil {
+		return nil, err
+	}
+	if err := hash.ValidateKeys(cfg.hmacKeys); err != nil {
+		return nil, err
+	}
+	hmac := hash.NewHMAC(cfg.hmacKeys...)
 	db, err := gorm.Open("postgres", connectionInfo)
 	if err != nil {
 		return nil, err
 	}
-	db.LogMode(true)
+	db.LogMode(cfg.logMode)
+	us := NewUserService(db, hmac, pw)
 	return &Services{
-		User:    NewUserService(db),
-		Gallery: NewGalleryService(db),
-		Image:   NewImageService(),
-		db:      db,
+		User:      us,
+		TwoFactor: NewTwoFactorService(db, hmac, us),
+		Session:   NewSessionService(db, hmac, cfg.session),
+		Login:     NewLoginThrottleService(db),
+		Gallery:   NewGalleryService(db, hmac, pw),
+		Image:     NewImageService(db, hmac, cfg.imageStore, cfg.image),
+		db:        db,
 	}, nil
 }
 
 // Services contains all the services.
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery   GalleryService
+	User      UserService
+	Session   SessionService
+	Login     LoginThrottleService
+	TwoFactor TwoFactorService
+	Image     ImageService
+	db        *gorm.DB
 }
 
 // Close closes the database for the service.
@@ -30,14 +156,97 @@ func (s *Services) Close() error {
 	return s.db.Close()
 }
 
+// DeleteUser permanently deletes a user's account along with everything that
+// belongs to it: their sessions, password reset tokens, recovery codes,
+// failed logins, galleries, images and the stored image files. Rows are
+// removed rather than soft deleted, so nothing personal is left behind and
+// the email address can be used again.
+//
+// Sessions are revoked first. Stored files are deleted next, gallery by
+// gallery, and the rows last in a single transaction, so a failure part way
+// through can simply be retried.
+func (s *Services) DeleteUser(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	user, err := s.User.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.Session.DeleteByUserID(id); err != nil {
+		return err
+	}
+	if err := s.Login.Forget(user.Email); err != nil {
+		return err
+	}
+	var galleryIDs []uint
+	err = s.db.Unscoped().Model(&Gallery{}).Where("user_id = ?", id).
+		Pluck("id", &galleryIDs).Error
+	if err != nil {
+		return err
+	}
+	for _, galleryID := range galleryIDs {
+		if err := s.Image.DeleteByGalleryID(galleryID); err != nil {
+			return err
+		}
+	}
+
+	tx := s.db.Begin().Unscoped()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	images := tx.Table("images").Select("id").
+		Where("gallery_id IN (?)", galleryIDs).QueryExpr()
+	galleryKeys := make([]string, len(galleryIDs))
+	for i, galleryID := range galleryIDs {
+		galleryKeys[i] = galleryKey(galleryID)
+	}
+	steps := []struct {
+		where string
+		arg   interface{}
+		value interface{}
+	}{
+		{"image_id IN (?)", images, &ImageVariant{}},
+		{"gallery_id IN (?)", galleryIDs, &Image{}},
+		{"user_id = ?", id, &Gallery{}},
+		{"key IN (?)", galleryKeys, &loginThrottle{}},
+		{"user_id = ?", id, &pwReset{}},
+		{"user_id = ?", id, &recoveryCode{}},
+		{"user_id = ?", id, &Session{}},
+		{"id = ?", id, &User{}},
+	}
+	for _, step := range steps {
+		err := tx.Where(step.where, step.arg).Delete(step.value).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
 // AutoMigrate will attempt to automatically migrate all tables.
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	err := s.db.AutoMigrate(&User{}, &Session{}, &pwReset{},
+		&recoveryCode{}, &loginThrottle{}, &Gallery{}, &Image{},
+		&ImageVariant{}).Error
+	if err != nil {
+		return err
+	}
+	// Remember tokens used to live on the user, one per account. They now
+	// live in the sessions table, so drop the old column (and its NOT NULL
+	// constraint) when migrating an existing database.
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		return s.db.Model(&User{}).DropColumn("remember_hash").Error
+	}
+	return nil
 }
 
 // DestructiveReset drops all tables and rebuilds them.
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Session{}, &pwReset{},
+		&recoveryCode{}, &loginThrottle{}, &Gallery{}, &Image{},
+		&ImageVariant{}).Error
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,346 @@
+package models
+
+import (
+	"time"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+var _ SessionDB = &sessionGorm{}
+
+const (
+	// DefaultSessionLifetime is how long a session lasts after sign in,
+	// however active it is.
+	DefaultSessionLifetime = 30 * 24 * time.Hour
+	// DefaultSessionIdleTimeout is how long a session lasts without being
+	// used.
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
+)
+
+// SessionConfig holds the server-side timeouts of sessions.
+type SessionConfig struct {
+	// Lifetime is the absolute timeout: a session ends this long after sign
+	// in.
+	Lifetime time.Duration
+	// IdleTimeout ends a session that has not been used for this long. Zero
+	// disables it.
+	IdleTimeout time.Duration
+}
+
+// Session models a signed in device. The remember token stored in the
+// device's cookie is only kept as an HMAC hash, so a leaked database cannot be
+// used to sign in.
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Expired reports whether the session has passed its absolute expiry, or has
+// not been used within idleTimeout. A zero idleTimeout is ignored.
+func (s *Session) Expired(now time.Time, idleTimeout time.Duration) bool {
+	if !now.Before(s.ExpiresAt) {
+		return true
+	}
+	return idleTimeout > 0 && now.Sub(s.LastSeenAt) >= idleTimeout
+}
+
+// SessionService is a set of methods used to manipulate and work with the
+// session model.
+type SessionService interface {
+	// Expired reports whether the session has timed out under the configured
+	// SessionConfig.
+	Expired(session *Session) bool
+	SessionDB
+}
+
+// SessionDB is used to interact with the sessions database.
+type SessionDB interface {
+	ByID(id uint) (*Session, error)
+	// ByToken looks up a session by its remember token. The session may
+	// have expired; see SessionService.Expired.
+	ByToken(token string) (*Session, error)
+	// ByUserID returns the user's sessions, most recently used first. The
+	// SessionService leaves out, and deletes, those that have timed out.
+	ByUserID(userID uint) ([]Session, error)
+	// Create generates the session's remember token, unless one is set, and
+	// stores the session.
+	Create(session *Session) error
+	// Touch records that the session was used at the given time.
+	Touch(session *Session, at time.Time) error
+	// Rekey replaces the session's token hash with one made with the current
+	// HMAC key. The session's Token must be set.
+	Rekey(session *Session) error
+	Delete(id uint) error
+	// DeleteByUserID deletes every session of the given user.
+	DeleteByUserID(userID uint) error
+	// DeleteExpired deletes the user's sessions that have expired at now or
+	// have not been used for idleTimeout. A zero idleTimeout only deletes
+	// expired sessions.
+	DeleteExpired(userID uint, now time.Time, idleTimeout time.Duration) error
+}
+
+type sessionService struct {
+	SessionDB
+	cfg SessionConfig
+}
+
+// NewSessionService creates a new SessionService. Remember tokens are hashed
+// with hmac; sessions hashed with an older key are rekeyed when next used.
+func NewSessionService(db *gorm.DB, hmac hash.HMAC, cfg SessionConfig) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hmac,
+			lifetime:  cfg.Lifetime,
+		},
+		cfg: cfg,
+	}
+}
+
+func (ss *sessionService) Expired(session *Session) bool {
+	return session.Expired(time.Now(), ss.cfg.IdleTimeout)
+}
+
+func (ss *sessionService) ByUserID(userID uint) ([]Session, error) {
+	now := time.Now()
+	err := ss.SessionDB.DeleteExpired(userID, now, ss.cfg.IdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+	all, err := ss.SessionDB.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	// A session may time out between the delete and the query.
+	sessions := all[:0]
+	for _, session := range all {
+		if !session.Expired(now, ss.cfg.IdleTimeout) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("id = ?", id), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByToken expects the hashed token; the validator takes care of hashing.
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID returns the user's sessions, most recently used first.
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	db := sg.db.Where("user_id = ?", userID).Order("last_seen_at desc")
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Touch(session *Session, at time.Time) error {
+	session.LastSeenAt = at
+	return sg.db.Model(session).UpdateColumn("last_seen_at", at).Error
+}
+
+func (sg *sessionGorm) Rekey(session *Session) error {
+	return sg.db.Model(session).
+		UpdateColumn("token_hash", session.TokenHash).Error
+}
+
+// Delete removes the session for good; revoked sessions are not kept around.
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Unscoped().Where("user_id = ?", userID).
+		Delete(&Session{}).Error
+}
+
+func (sg *sessionGorm) DeleteExpired(userID uint, now time.Time, idleTimeout time.Duration) error {
+	db := sg.db.Unscoped().Where("user_id = ?", userID)
+	if idleTimeout > 0 {
+		db = db.Where("expires_at <= ? OR last_seen_at <= ?",
+			now, now.Add(-idleTimeout))
+	} else {
+		db = db.Where("expires_at <= ?", now)
+	}
+	return db.Delete(&Session{}).Error
+}
+
+// sessionValidator validates and normalizes sessions before passing them on
+// to the next SessionDB in the chain.
+type sessionValidator struct {
+	SessionDB
+	hmac     hash.HMAC
+	lifetime time.Duration
+}
+
+// ByToken tries the token's hash under each HMAC key in turn. A session
+// found under an older key is rekeyed while we have its token, which is the
+// only time we can.
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	for _, tokenHash := range sv.hmac.Hashes(token) {
+		session, err := sv.SessionDB.ByToken(tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !sv.hmac.Current(session.TokenHash) {
+			session.Token = token
+			if err := sv.Rekey(session); err != nil {
+				return nil, err
+			}
+		}
+		return session, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (sv *sessionValidator) Rekey(session *Session) error {
+	err := runSessionValFns(session, sv.hmacToken, sv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Rekey(session)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(
+		session,
+		sv.userIDRequired,
+		sv.setTokenIfUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+		sv.setTimes,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+func (sv *sessionValidator) DeleteExpired(userID uint, now time.Time, idleTimeout time.Duration) error {
+	if userID <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.DeleteExpired(userID, now, idleTimeout)
+}
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *sessionValidator) userIDRequired(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(s *Session) error {
+	if s.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(s *Session) error {
+	n, err := rand.NBytes(s.Token)
+	if err != nil {
+		return err
+	}
+	if n < 32 {
+		return ErrRememberTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	if s.Token == "" {
+		return nil
+	}
+	s.TokenHash = sv.hmac.Hash(s.Token)
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(s *Session) error {
+	if s.TokenHash == "" {
+		return ErrRememberRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTimes(s *Session) error {
+	now := time.Now()
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(sv.lifetime)
+	}
+	return nil
+}
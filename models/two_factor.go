@@ -0,0 +1,244 @@
+package models
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
+	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+	"github.com/matthewrankin/lenslocked/internal/pkg/totp"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrTOTPCodeInvalid is returned when a two-factor code or recovery code
+	// is wrong or has already been used.
+	ErrTOTPCodeInvalid modelError = "models: the code provided is not valid"
+	// ErrTOTPNotEnrolled is returned when enabling two-factor authentication
+	// before a secret has been generated.
+	ErrTOTPNotEnrolled modelError = "models: two-factor authentication has not been set up"
+	// ErrTOTPEnabled is returned when setting up two-factor authentication
+	// for a user who already has it enabled.
+	ErrTOTPEnabled modelError = "models: two-factor authentication is already enabled"
+
+	// recoveryCodeCount is how many recovery codes a user gets.
+	recoveryCodeCount = 10
+	// loginChallengeDuration is how long a user has to enter their
+	// two-factor code after their password.
+	loginChallengeDuration = 5 * time.Minute
+	// totpIssuer names the account in authenticator apps.
+	totpIssuer = "LensLocked"
+)
+
+// recoveryCode lets a user sign in once without their authenticator. Only an
+// HMAC hash of the code is stored.
+type recoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;unique_index"`
+}
+
+// TOTPEnabled reports whether the user has turned on two-factor
+// authentication.
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// TwoFactorService manages TOTP two-factor authentication.
+type TwoFactorService interface {
+	// Enroll generates a new TOTP secret for a user who has not enabled
+	// two-factor authentication yet.
+	Enroll(user *User) error
+	// URI returns the otpauth:// URI that adds the user's secret to an
+	// authenticator app.
+	URI(user *User) string
+	// Enable turns on two-factor authentication once the user proves their
+	// app works by entering a code. It returns the user's recovery codes,
+	// which are not stored and cannot be shown again.
+	Enable(user *User, code string) ([]string, error)
+	// Disable turns off two-factor authentication and removes the recovery
+	// codes.
+	Disable(user *User) error
+	// Verify checks a code from the user's authenticator app, or one of
+	// their unused recovery codes, which is then used up.
+	Verify(user *User, code string) error
+	// LoginChallenge returns a short-lived token recording that the user
+	// entered the right password, so they can be asked for their code.
+	LoginChallenge(user *User) string
+	// ByLoginChallenge returns the user a login challenge was created for.
+	ByLoginChallenge(token string) (*User, error)
+}
+
+type twoFactorService struct {
+	us   UserService
+	db   *gorm.DB
+	hmac hash.HMAC
+}
+
+// NewTwoFactorService creates a new TwoFactorService.
+func NewTwoFactorService(db *gorm.DB, hmac hash.HMAC, us UserService) TwoFactorService {
+	return &twoFactorService{
+		us:   us,
+		db:   db,
+		hmac: hmac,
+	}
+}
+
+func (tfs *twoFactorService) Enroll(user *User) error {
+	if user.TOTPEnabled() {
+		return ErrTOTPEnabled
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) URI(user *User) string {
+	return totp.URI(totpIssuer, user.Email, user.TOTPSecret)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled() {
+		return nil, ErrTOTPEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	codes, err := tfs.newRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	if err := tfs.us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (tfs *twoFactorService) Disable(user *User) error {
+	err := tfs.db.Unscoped().Where("user_id = ?", user.ID).
+		Delete(&recoveryCode{}).Error
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.TOTPEnabled() {
+		return ErrTOTPNotEnrolled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if ok {
+		// Each code works once, so an observed code cannot be replayed.
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeInvalid
+		}
+		user.TOTPLastStep = step
+		return tfs.us.Update(user)
+	}
+	return tfs.useRecoveryCode(user.ID, code)
+}
+
+// LoginChallenge tokens are signed rather than stored, like email
+// verification tokens.
+func (tfs *twoFactorService) LoginChallenge(user *User) string {
+	exp := time.Now().Add(loginChallengeDuration).Unix()
+	sig := tfs.hmac.Hash(loginChallengeMessage(user.ID, exp))
+	return fmt.Sprintf("%d.%d.%s", user.ID, exp, sig)
+}
+
+func (tfs *twoFactorService) ByLoginChallenge(token string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, ErrTokenInvalid
+	}
+	if !tfs.hmac.Equal(loginChallengeMessage(uint(id), exp), parts[2]) {
+		return nil, ErrTokenInvalid
+	}
+	return tfs.us.ByID(uint(id))
+}
+
+// newRecoveryCodes replaces the user's recovery codes with new ones.
+func (tfs *twoFactorService) newRecoveryCodes(userID uint) ([]string, error) {
+	tx := tfs.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	err := tx.Unscoped().Where("user_id = ?", userID).
+		Delete(&recoveryCode{}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(10)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		// Ten base32 characters (50 bits), shown as two groups of five.
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b)[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+		rc := recoveryCode{UserID: userID, CodeHash: tfs.hashRecoveryCode(code)}
+		if err := tx.Create(&rc).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return codes, tx.Commit().Error
+}
+
+// useRecoveryCode deletes the matching recovery code of the user, or returns
+// ErrTOTPCodeInvalid if there is none.
+func (tfs *twoFactorService) useRecoveryCode(userID uint, code string) error {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	hashes := tfs.hmac.Hashes(recoveryCodeMessage(code))
+	res := tfs.db.Unscoped().
+		Where("user_id = ? AND code_hash IN (?)", userID, hashes).
+		Delete(&recoveryCode{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTOTPCodeInvalid
+	}
+	return nil
+}
+
+func (tfs *twoFactorService) hashRecoveryCode(code string) string {
+	return tfs.hmac.Hash(recoveryCodeMessage(code))
+}
+
+func recoveryCodeMessage(code string) string {
+	return "recovery:" + code
+}
+
+func loginChallengeMessage(userID uint, expires int64) string {
+	return fmt.Sprintf("2fa:%d:%d", userID, expires)
+}
@@ -3,13 +3,13 @@ package models
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/matthewrankin/lenslocked/internal/pkg/hash"
-	"github.com/matthewrankin/lenslocked/internal/pkg/rand"
+	"github.com/matthewrankin/lenslocked/internal/pkg/password"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres" // Blank import needed here.
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -40,16 +40,19 @@ const (
 	// ErrPasswordTooShort is returned when a user tries to set a password that
 	// is less than 8 characters long.
 	ErrPasswordTooShort modelError = "models: password must be at least 8 characters long"
-	// ErrRememberRequired is returned when a create or update is attempted
-	// without a user remember token hash
+	// ErrRememberRequired is returned when a session is created without a
+	// remember token hash.
 	ErrRememberRequired modelError = "models: remember token is required"
 	// ErrRememberTooShort is returned when a remember token is not at least 32
 	// bytes.
 	ErrRememberTooShort modelError = "models: remember token must be at least 32 bytes"
-	userPwPepper                   = "secret-random-string"
 )
 
+// The pepper and HMAC key used when none are configured, which is fine for
+// development only. They have empty key IDs, as hashes made before keys had
+// IDs do.
 const (
+	userPwPepper  = "secret-random-string"
 	hmacSecretKey = "secret-hmac-key"
 )
 
@@ -81,7 +84,6 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User) error
@@ -98,27 +100,19 @@ type userGorm struct {
 // before passing it on to the next UserDB in our interface chain.
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
+	pw         password.Hasher
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC) *userValidator {
+func newUserValidator(udb UserDB, pw password.Hasher) *userValidator {
 	return &userValidator{
 		UserDB: udb,
-		hmac:   hmac,
+		pw:     pw,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 	}
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
 // User models a user
 type User struct {
 	gorm.Model
@@ -126,28 +120,64 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	// EmailVerifiedAt is when the user proved they own Email. It is nil
+	// until then.
+	EmailVerifiedAt *time.Time
+	// TOTPSecret is the user's two-factor secret. It is set during
+	// enrollment, before two-factor authentication is enabled at
+	// TOTPEnabledAt.
+	TOTPSecret    string
+	TOTPEnabledAt *time.Time
+	// TOTPLastStep is the time step of the last code used, which cannot be
+	// used again.
+	TOTPLastStep int64
+}
+
+// Verified reports whether the user has verified their email address.
+func (u *User) Verified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 // UserService is a set of methods used to manipulate and work with the user
 // model.
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+	// InitiateReset creates a password reset token for the user with the
+	// given email address and returns the user along with the token.
+	InitiateReset(email string) (*User, string, error)
+	// CompleteReset sets a new password for the user the reset token was
+	// created for and uses the token up. It returns ErrTokenInvalid if the
+	// token is unknown, used or expired.
+	CompleteReset(token, newPw string) (*User, error)
+	// VerificationToken returns a token proving the user received an email
+	// at their current address.
+	VerificationToken(user *User) string
+	// VerifyEmail marks the email address the token was created for as
+	// verified. It returns ErrTokenInvalid if the token is invalid, expired
+	// or for an address the user no longer has.
+	VerifyEmail(token string) (*User, error)
 	UserDB
 }
 
 type userService struct {
 	UserDB
+	pwResetDB pwResetDB
+	hmac      hash.HMAC
+	pw        password.Hasher
 }
 
-// NewUserService creates a new UserService.
-func NewUserService(db *gorm.DB) UserService {
+// NewUserService creates a new UserService. New passwords are hashed with
+// the given hasher, and existing hashes are upgraded to its policy and
+// current pepper as users sign in.
+func NewUserService(db *gorm.DB, hmac hash.HMAC, pw password.Hasher) UserService {
 	ug := &userGorm{db}
-	hmac := hash.NewHMAC(hmacSecretKey)
-	uv := newUserValidator(ug, hmac)
+	uv := newUserValidator(ug, pw)
+	pwrv := newPwResetValidator(&pwResetGorm{db}, hmac)
 	return &userService{
-		UserDB: uv,
+		UserDB:    uv,
+		pwResetDB: pwrv,
+		hmac:      hmac,
+		pw:        pw,
 	}
 }
 
@@ -189,15 +219,13 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// Update will hash a remember token if it is provided.
+// Update will hash a password if it is provided.
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFns(
 		user,
 		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.hashPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -209,19 +237,6 @@ func (uv *userValidator) Update(user *User) error {
 	return uv.UserDB.Update(user)
 }
 
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-
-	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
 // Update will update the provided user with all of the data in the provided
 // user object.
 func (ug *userGorm) Update(user *User) error {
@@ -252,11 +267,8 @@ func (uv *userValidator) Create(user *User) error {
 		user,
 		uv.passwordRequired,
 		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.hashPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -300,61 +312,92 @@ func first(db *gorm.DB, dst interface{}) error {
 // return nil, ErrPasswordIncorrect. If the email and password are both valid,
 // this will return user, nil. Otherwise if another error is encountered this
 // will return nil, error.
-func (us *userService) Authenticate(email, password string) (*User, error) {
+//
+// When the stored hash was made under an older password policy or with an
+// older pepper, it is replaced with one made under the current ones.
+func (us *userService) Authenticate(email, pw string) (*User, error) {
 	foundUser, err := us.ByEmail(email)
+	if err == ErrNotFound {
+		// Spend as long as checking a real password would, so response
+		// times do not reveal which email addresses have accounts.
+		us.pw.Hash(pw)
+		return nil, err
+	}
 	if err != nil {
 		return nil, err
 	}
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash), []byte(password+userPwPepper))
+	err = us.pw.Compare(foundUser.PasswordHash, pw)
 	switch err {
 	case nil:
-		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
+	case password.ErrMismatch:
 		return nil, ErrPasswordIncorrect
 	default:
 		return nil, err
 	}
+	if us.pw.NeedsRehash(foundUser.PasswordHash) {
+		// The old hash still works, so if saving the new one fails the
+		// upgrade is simply tried again at the next sign in.
+		rehashed := *foundUser
+		rehashed.Password = pw
+		if err := us.Update(&rehashed); err == nil {
+			foundUser = &rehashed
+		}
+	}
+	return foundUser, nil
 }
 
-// ByRemember looks up a user with the given remember token and returns that
-// user. This method will handle hashing the token for us.
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
+// InitiateReset returns ErrNotFound if no user has the email address.
+func (us *userService) InitiateReset(email string) (*User, string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return nil, "", err
 	}
-	if err := runUserValFns(&user, uv.hmacRemember); err != nil {
-		return nil, err
+	pwr := pwReset{UserID: user.ID}
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return nil, "", err
 	}
-	return uv.UserDB.ByRemember(user.RememberHash)
+	return user, pwr.Token, nil
 }
 
-// ByRemember looks up a user with the given remember token and returns that
-// user. This method will handle hashing the token for us.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if time.Since(pwr.CreatedAt) > pwResetDuration {
+		us.pwResetDB.Delete(pwr.ID)
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(pwr.UserID)
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	user.Password = newPw
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	if err := us.pwResetDB.Delete(pwr.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 type userValFn func(*User) error
 
-// bcryptPassword will hash a user's password with an
-// app-wide pepper and bcrypt, which salts for us.
-func (uv *userValidator) bcryptPassword(user *User) error {
+// hashPassword will hash a user's password with an app-wide pepper
+// according to the password policy. The hash includes its own salt.
+func (uv *userValidator) hashPassword(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	pwBytes := []byte(user.Password + userPwPepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes,
-		bcrypt.DefaultCost)
+	hashed, err := uv.pw.Hash(user.Password)
 	if err != nil {
 		return err
 	}
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hashed
 	user.Password = ""
 	return nil
 }
@@ -431,24 +474,3 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	}
 	return nil
 }
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emailVerificationDuration is how long an email verification link works.
+const emailVerificationDuration = 7 * 24 * time.Hour
+
+// VerificationToken tokens are signed rather than stored. They cover the
+// email address, so changing it invalidates any links already sent.
+func (us *userService) VerificationToken(user *User) string {
+	exp := time.Now().Add(emailVerificationDuration).Unix()
+	sig := us.hmac.Hash(verificationMessage(user.ID, user.Email, exp))
+	return fmt.Sprintf("%d.%d.%s", user.ID, exp, sig)
+}
+
+func (us *userService) VerifyEmail(token string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !us.hmac.Equal(verificationMessage(user.ID, user.Email, exp), parts[2]) {
+		return nil, ErrTokenInvalid
+	}
+	if user.Verified() {
+		return user, nil
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func verificationMessage(userID uint, email string, expires int64) string {
+	return fmt.Sprintf("verify:%d:%s:%d", userID, email, expires)
+}
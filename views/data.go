@@ -1,6 +1,7 @@
 package views
 
 import (
+	"html/template"
 	"log"
 
 	"github.com/matthewrankin/lenslocked/models"
@@ -34,7 +35,11 @@ type Alert struct {
 type Data struct {
 	Alert *Alert
 	User  *models.User
-	Yield interface{}
+	// CSRFField is the hidden input carrying the CSRF token that every form
+	// which changes state must include. Templates rendered as "yield" only
+	// see Yield, so they use the csrfField template function instead.
+	CSRFField template.HTML
+	Yield     interface{}
 }
 
 // SetAlert sets an alert on the Data type.
@@ -2,12 +2,15 @@ package views
 
 import (
 	"bytes"
+	"errors"
 	"html/template"
 	"io"
 	"net/http"
 	"path/filepath"
 
 	"github.com/matthewrankin/lenslocked/context"
+
+	"github.com/gorilla/csrf"
 )
 
 // Globals to help glob.
@@ -22,7 +25,12 @@ func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 	files = append(files, layoutFiles()...)
-	t, err := template.ParseFiles(files...)
+	t, err := template.New("").Funcs(template.FuncMap{
+		// csrfField is replaced at render time; see Render.
+		"csrfField": func() (template.HTML, error) {
+			return "", errors.New("csrfField is not implemented")
+		},
+	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
 	}
@@ -52,8 +60,21 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 		}
 	}
 	vd.User = context.User(r.Context())
+	vd.CSRFField = csrf.TemplateField(r)
+	// Templates are shared between requests, so the CSRF field is bound to a
+	// copy of the template.
+	tpl, err := v.Template.Clone()
+	if err == nil {
+		tpl = tpl.Funcs(template.FuncMap{
+			"csrfField": func() template.HTML {
+				return vd.CSRFField
+			},
+		})
+	}
 	var buf bytes.Buffer
-	err := v.Template.ExecuteTemplate(&buf, v.Layout, vd)
+	if err == nil {
+		err = tpl.ExecuteTemplate(&buf, v.Layout, vd)
+	}
 	if err != nil {
 		http.Error(w, "Something went wrong. If the problem persists, please "+
 			"email support@lenslocked.com", http.StatusInternalServerError)